@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Aggregator aggregates many inputs in turn on the same worker goroutines, for
+// programs that would otherwise call Aggregate in a loop, such as once per
+// file. The workers are started by NewAggregator and keep their stats between
+// calls to Add, so several inputs can be aggregated together; Result returns
+// what was added since the previous Result and starts over. Close stops the
+// workers.
+//
+// Every input is split into chunks like Aggregate's, and every worker merges
+// the chunks it processes into a map of its own, as in aggregateStream. Names
+// are copied into those maps, so an input can be unmapped or reused as soon as
+// Add returns. An Aggregator is not safe for concurrent use.
+type Aggregator struct {
+	opts    Options
+	tasks   chan aggregatorTask
+	workers []aggregatorWorker
+	wg      sync.WaitGroup
+
+	bytes int64 // added since the last Result
+	lines int64 // added since the last Result, with Provenance
+}
+
+// aggregatorWorker is what a worker of an Aggregator has aggregated since the
+// last Result.
+type aggregatorWorker struct {
+	stats     map[string]*StationStats
+	rows      int64
+	malformed int64
+	busy      time.Duration
+}
+
+// aggregatorTask is a chunk of an input handed to the workers by Add.
+type aggregatorTask struct {
+	ctx   context.Context
+	data  string
+	chunk [2]int64
+	opts  Options // with the header and first line of the chunk
+	batch *aggregatorBatch
+}
+
+// aggregatorBatch tracks the chunks of one call to Add. The first error
+// cancels the chunks still to be processed.
+type aggregatorBatch struct {
+	wg     sync.WaitGroup
+	once   sync.Once
+	cancel context.CancelFunc
+	err    error
+}
+
+func (b *aggregatorBatch) fail(err error) {
+	b.once.Do(func() {
+		b.err = err
+		b.cancel()
+	})
+}
+
+// NewAggregator starts opts.Workers workers that aggregate the inputs given to
+// Add with opts. Options.Shared, Prefault and Explain don't apply to an
+// Aggregator and are ignored.
+func NewAggregator(opts Options) (*Aggregator, error) {
+	if opts.Workers < 1 {
+		return nil, fmt.Errorf("number of workers must be at least 1, got %d", opts.Workers)
+	}
+	opts.Shared, opts.Prefault, opts.Explain = false, false, nil
+	a := &Aggregator{
+		opts:    opts,
+		tasks:   make(chan aggregatorTask, opts.Workers),
+		workers: make([]aggregatorWorker, opts.Workers),
+	}
+	a.reset()
+	for i := range a.workers {
+		a.wg.Add(1)
+		go a.work(&a.workers[i])
+	}
+	return a, nil
+}
+
+func (a *Aggregator) work(w *aggregatorWorker) {
+	defer a.wg.Done()
+	for t := range a.tasks {
+		res, err := processChunk(t.ctx, t.data, t.chunk, t.opts)
+		if res.stats != nil {
+			mergeStats(w.stats, res.stats, a.opts)
+			releaseTable(res.stats)
+		}
+		w.rows += res.rows
+		w.malformed += res.malformed
+		w.busy += res.duration
+		if err != nil {
+			t.batch.fail(err)
+		}
+		t.batch.wg.Done()
+	}
+}
+
+// Add aggregates data into the stats kept since the last Result. Positions in
+// the errors it returns are relative to data. When it fails, everything added
+// since the last Result is dropped, except that cancellation of ctx keeps
+// what the workers got through, as Aggregate returns it.
+func (a *Aggregator) Add(ctx context.Context, data string) error {
+	chunks, err := CalculateChunks(data, int64(len(data)), a.opts.Workers)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	batch := &aggregatorBatch{cancel: cancel}
+	line := a.lines + 1
+	for _, c := range chunks {
+		opts := a.opts
+		opts.offset = a.bytes
+		if first := c[0] == 0; first {
+			c[0] = min(bomLen(data), c[1])
+			opts.header = a.opts.SkipHeader
+		}
+		if a.opts.Provenance {
+			opts.firstLine = line
+			line += int64(strings.Count(data[c[0]:c[1]], "\n"))
+		}
+		batch.wg.Add(1)
+		a.tasks <- aggregatorTask{ctx, data, c, opts, batch}
+	}
+	batch.wg.Wait()
+
+	if batch.err != nil && !canceled(batch.err) {
+		a.reset()
+		return batch.err
+	}
+	a.bytes += int64(len(data))
+	a.lines = line - 1
+	if a.opts.Provenance && len(data) > 0 && data[len(data)-1] != '\n' {
+		// The next input starts on a line of its own.
+		a.lines++
+	}
+	return batch.err
+}
+
+// Result returns the stats of the inputs added since the last call to Result,
+// as if they had been aggregated together by Aggregate, and empties the
+// Aggregator for the next ones.
+func (a *Aggregator) Result() (Result, error) {
+	result := Result{Stats: make(map[string]StationStats), Bytes: a.bytes}
+	for i := range a.workers {
+		w := &a.workers[i]
+		mergeResults(&result, Result{
+			Stats:       flattenStats(w.stats),
+			Rows:        w.rows,
+			Malformed:   w.malformed,
+			WorkerTimes: []time.Duration{w.busy},
+		}, a.opts)
+	}
+	a.reset()
+	if err := checkSums(result.Stats); err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
+
+// Close stops the workers. The Aggregator must not be used afterwards.
+func (a *Aggregator) Close() {
+	close(a.tasks)
+	a.wg.Wait()
+}
+
+// reset drops everything aggregated since the last Result.
+func (a *Aggregator) reset() {
+	for i := range a.workers {
+		a.workers[i] = aggregatorWorker{stats: make(map[string]*StationStats)}
+	}
+	a.bytes, a.lines = 0, 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// requireSameStats compares the stats of two results, M2 within rounding since
+// it depends on the order in which partial stats are merged, and samples as
+// sets since their heaps may be in a different order.
+func requireSameStats(t *testing.T, want, got Result) {
+	t.Helper()
+	require.Equal(t, want.Rows, got.Rows)
+	require.Equal(t, want.Bytes, got.Bytes)
+	require.Len(t, got.Stats, len(want.Stats))
+	for name, w := range want.Stats {
+		g := got.Stats[name]
+		require.InDelta(t, w.M2, g.M2, 1e-6, name)
+		require.ElementsMatch(t, w.Sample.Keys, g.Sample.Keys, name)
+		require.ElementsMatch(t, w.Sample.Temps, g.Sample.Temps, name)
+		w.M2, g.M2 = 0, 0
+		w.Sample, g.Sample = nil, nil
+		require.Equal(t, w, g, name)
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	data := benchmarkData()[:200_000]
+	cut := strings.LastIndexByte(data[:120_000], '\n') + 1
+	first, second := data[:cut], data[cut:strings.LastIndexByte(data, '\n')+1]
+	opts := Options{Workers: 3, Median: true, StdDev: true, Provenance: true, Sample: 5}
+
+	a, err := NewAggregator(opts)
+	require.NoError(t, err)
+	defer a.Close()
+
+	// One input at a time, like Aggregate.
+	for _, input := range []string{first, second} {
+		want, err := Aggregate(context.Background(), input, opts)
+		require.NoError(t, err)
+		require.NoError(t, a.Add(context.Background(), input))
+		got, err := a.Result()
+		require.NoError(t, err)
+		requireSameStats(t, want, got)
+		require.Len(t, got.WorkerTimes, 3)
+	}
+
+	// Both inputs together, like Aggregate over both.
+	want, err := Aggregate(context.Background(), first+second, opts)
+	require.NoError(t, err)
+	require.NoError(t, a.Add(context.Background(), first))
+	require.NoError(t, a.Add(context.Background(), second))
+	got, err := a.Result()
+	require.NoError(t, err)
+	requireSameStats(t, want, got)
+}
+
+func TestAggregatorProvenance(t *testing.T) {
+	a, err := NewAggregator(Options{Workers: 2, Provenance: true})
+	require.NoError(t, err)
+	defer a.Close()
+
+	// Lines are numbered across inputs, and an input without a trailing
+	// newline still ends its last line.
+	require.NoError(t, a.Add(context.Background(), "x;1.00\ny;2.00"))
+	require.NoError(t, a.Add(context.Background(), "z;1.00\nx;3.00\n"))
+	require.NoError(t, a.Add(context.Background(), "y;4.00\n"))
+	got, err := a.Result()
+	require.NoError(t, err)
+	for name, want := range map[string][2]int64{"x": {1, 4}, "y": {2, 5}, "z": {3, 3}} {
+		s := got.Stats[name]
+		require.Equal(t, want, [2]int64{s.First, s.Last}, name)
+	}
+
+	// Result starts the numbering over.
+	require.NoError(t, a.Add(context.Background(), "z;1.00\n"))
+	got, err = a.Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), got.Stats["z"].First)
+}
+
+func TestAggregatorCopiesNames(t *testing.T) {
+	a, err := NewAggregator(Options{Workers: 2})
+	require.NoError(t, err)
+	defer a.Close()
+
+	// Reuse the buffer of the first input for the second, as a caller
+	// reading files into one buffer would.
+	buf := []byte("stationA;10.00\nstationB;20.00\n")
+	require.NoError(t, a.Add(context.Background(), unsafe.String(&buf[0], len(buf))))
+	copy(buf, "stationC;30.00\nstationD;40.00\n")
+	require.NoError(t, a.Add(context.Background(), unsafe.String(&buf[0], len(buf))))
+
+	got, err := a.Result()
+	require.NoError(t, err)
+	require.Equal(t, map[string]StationStats{
+		"stationA": {Count: 1, Min: 1000, Max: 1000, Sum: 1000},
+		"stationB": {Count: 1, Min: 2000, Max: 2000, Sum: 2000},
+		"stationC": {Count: 1, Min: 3000, Max: 3000, Sum: 3000},
+		"stationD": {Count: 1, Min: 4000, Max: 4000, Sum: 4000},
+	}, got.Stats)
+}
+
+func TestAggregatorError(t *testing.T) {
+	_, err := NewAggregator(Options{})
+	require.EqualError(t, err, "number of workers must be at least 1, got 0")
+
+	a, err := NewAggregator(Options{Workers: 2})
+	require.NoError(t, err)
+	defer a.Close()
+
+	require.NoError(t, a.Add(context.Background(), "stationA;10.00\n"))
+	err = a.Add(context.Background(), "stationB;20.00\nstationB;2O.00\n")
+	require.ErrorIs(t, err, ErrMalformedNumber)
+	require.ErrorContains(t, err, "on line 2 (byte 15)")
+
+	// The failed input drops what was added before it too.
+	require.NoError(t, a.Add(context.Background(), "stationC;30.00\n"))
+	got, err := a.Result()
+	require.NoError(t, err)
+	require.Equal(t, map[string]StationStats{
+		"stationC": {Count: 1, Min: 3000, Max: 3000, Sum: 3000},
+	}, got.Stats)
+	require.Equal(t, int64(15), got.Bytes)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A checkpoint lets a long run over a single mapped file be split across
+// sessions. The file is aggregated in segments of checkpointInterval bytes, cut
+// at newlines, and after every segment the merged stats and the offset reached
+// are written to the checkpoint file. A run given the same checkpoint skips
+// straight to that offset.
+//
+// The checkpoint is only replaced once a segment is fully merged, by writing a
+// temporary file and renaming it over the old one, so it always describes
+// exactly the records before Offset: a run that is killed or fails loses at
+// most the segment it was working on, which the next session redoes. It is
+// removed once the whole file is done.
+//
+// Resuming assumes the input hasn't changed in between. The path, size and
+// modification time of the file and the options that shape the stats are
+// checked, and a mismatch is an error rather than a silently wrong result, but
+// an edit that keeps all of those goes unnoticed.
+type checkpoint struct {
+	Path    string // absolute path of the input
+	Size    int64
+	ModTime time.Time
+	Options string // optionsKey of the run that wrote it
+
+	Offset    int64 // bytes of input aggregated into Stats
+	Lines     int64 // newlines before Offset, to position errors
+	Rows      int64
+	Malformed int64
+	Stats     map[string]StationStats
+}
+
+// checkpointInterval is how many bytes are aggregated between checkpoints. It's
+// a variable so tests can checkpoint small inputs.
+var checkpointInterval int64 = 1 << 30
+
+// optionsKey describes the options a checkpoint's stats depend on.
+func optionsKey(opts Options) string {
+	filter := ""
+	if opts.Filter != nil {
+		filter = opts.Filter.String()
+	}
+	return fmt.Sprintf("median=%t stddev=%t histogram=%t provenance=%t fold=%t sample=%d/%d skip-malformed=%t allow-special=%t validate=%t limit-bytes=%d delim=%q decimal-sep=%q temp-col=%d skip-header=%t comment=%q filter=%q",
+		opts.Median, opts.StdDev, opts.Histogram, opts.Provenance, opts.Fold, opts.Sample, opts.SampleSeed,
+		opts.SkipMalformed, opts.AllowSpecial, opts.Validate, opts.LimitBytes, opts.Delim, opts.decimalSep(), max(opts.TempCol, 1), opts.SkipHeader, opts.Comment, filter)
+}
+
+// loadCheckpoint reads the checkpoint at path. It returns nil without an error
+// if there is none yet.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening checkpoint: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var cp checkpoint
+	if err := gob.NewDecoder(f).Decode(&cp); err != nil {
+		return nil, fmt.Errorf("reading checkpoint %s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+// saveCheckpoint atomically replaces the checkpoint at path with cp.
+func saveCheckpoint(path string, cp *checkpoint) error {
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(cp)
+	})
+	if err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file at path with write, through a temporary file
+// next to it that is synced and renamed over path once complete, so readers
+// of path see either the old or the new contents, never a partial file.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// aggregateCheckpointed aggregates the file at path like aggregateFiles,
+// segment by segment, resuming from and saving to the checkpoint at
+// opts.Checkpoint.
+func aggregateCheckpointed(
+	ctx context.Context, path string, opts Options, logger *slog.Logger,
+) (Result, error) {
+	in, err := openInput(path, false, false, logger)
+	if err != nil {
+		return Result{}, err
+	}
+	defer in.close()
+	if in.reader != nil || in.window != nil {
+		return Result{}, fmt.Errorf("-checkpoint needs a file that can be memory-mapped, %s can't", path)
+	}
+	if err := in.limit(opts.LimitBytes); err != nil {
+		return Result{}, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return Result{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Result{}, err
+	}
+
+	cp, err := loadCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return Result{}, err
+	}
+	key := optionsKey(opts)
+	switch {
+	case cp == nil:
+		cp = &checkpoint{
+			Path:    abs,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Options: key,
+			Stats:   make(map[string]StationStats),
+		}
+	case cp.Path != abs || cp.Size != fi.Size() || !cp.ModTime.Equal(fi.ModTime()):
+		return Result{}, fmt.Errorf(
+			"checkpoint %s was written for a different or modified input, delete it to start over", opts.Checkpoint,
+		)
+	case cp.Options != key:
+		return Result{}, fmt.Errorf(
+			"checkpoint %s was written with different options (%s), delete it to start over", opts.Checkpoint, cp.Options,
+		)
+	default:
+		logger.Info("Resuming from checkpoint", "offset", cp.Offset, "size", cp.Size)
+	}
+
+	data := in.data
+	opts.Progress.setTotal(int64(len(data)))
+	opts.Progress.add(cp.Offset)
+	result := Result{
+		Stats:     cp.Stats,
+		Rows:      cp.Rows,
+		Malformed: cp.Malformed,
+		Bytes:     cp.Offset,
+	}
+	for cp.Offset < int64(len(data)) {
+		end := segmentEnd(data, cp.Offset+checkpointInterval)
+		segment := data[cp.Offset:end]
+		segmentOpts := opts
+		segmentOpts.offset = cp.Offset
+		segmentOpts.SkipHeader = opts.SkipHeader && cp.Offset == 0
+		res, err := aggregateAll(ctx, []string{segment}, segmentOpts)
+		if err != nil && !canceled(err) {
+			return Result{}, atOffset(err, cp.Offset, cp.Lines)
+		}
+		mergeSegment(&result, res, cp.Lines, opts)
+		if err != nil {
+			// Canceled: return the partial result, but leave the checkpoint
+			// at the last complete segment.
+			return result, err
+		}
+
+		cp.Offset = end
+		cp.Lines += int64(strings.Count(segment, "\n"))
+		cp.Stats, cp.Rows, cp.Malformed = result.Stats, result.Rows, result.Malformed
+		if err := saveCheckpoint(opts.Checkpoint, cp); err != nil {
+			return Result{}, err
+		}
+		logger.Debug("Saved checkpoint", "offset", cp.Offset)
+	}
+
+	if err := os.Remove(opts.Checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Result{}, fmt.Errorf("removing checkpoint: %w", err)
+	}
+	return result, nil
+}
+
+// segmentEnd returns the offset just past the first newline at or after end,
+// or len(data) if there is none.
+func segmentEnd(data string, end int64) int64 {
+	if end >= int64(len(data)) {
+		return int64(len(data))
+	}
+	i := strings.IndexByte(data[end:], '\n')
+	if i < 0 {
+		return int64(len(data))
+	}
+	return end + int64(i) + 1
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunCheckpointResumes(t *testing.T) {
+	defer func(n int64) { checkpointInterval = n }(checkpointInterval)
+	checkpointInterval = 1000
+
+	data := benchmarkData()[:20_000]
+	data = data[:strings.LastIndexByte(data, '\n')+1]
+	opts := Options{Workers: 2, Median: true, StdDev: true, Provenance: true}
+	want, err := Aggregate(context.Background(), data, opts)
+	require.NoError(t, err)
+
+	// Break a record past the first few segments so the first session fails
+	// there, as if it had been interrupted.
+	bad := strings.Index(data[5000:], "\n") + 5001
+	end := strings.IndexByte(data[bad:], '\n') + bad
+	broken := data[:end-1] + "x" + data[end:]
+	p := makeFile(t, broken)
+	fi, err := os.Stat(p)
+	require.NoError(t, err)
+
+	cpPath := filepath.Join(t.TempDir(), "run.checkpoint")
+	opts.Checkpoint = cpPath
+	_, err = Run(context.Background(), []string{p}, opts, nil)
+	line := strings.Count(data[:bad], "\n") + 1
+	require.ErrorContains(t, err, fmt.Sprintf("on line %d (byte %d)", line, bad))
+
+	cp, err := loadCheckpoint(cpPath)
+	require.NoError(t, err)
+	require.NotNil(t, cp)
+	require.Positive(t, cp.Offset)
+	require.LessOrEqual(t, cp.Offset, int64(bad))
+	require.Equal(t, int64(strings.Count(data[:cp.Offset], "\n")), cp.Rows)
+
+	// Repair the record in place, keeping the size and modification time.
+	require.NoError(t, os.WriteFile(p, []byte(data), 0o644))
+	require.NoError(t, os.Chtimes(p, fi.ModTime(), fi.ModTime()))
+
+	var log bytes.Buffer
+	got, err := Run(context.Background(), []string{p}, opts, testLogger(&log))
+	require.NoError(t, err)
+	require.Contains(t, log.String(), `msg="Resuming from checkpoint" offset=`)
+	require.Equal(t, want.Rows, got.Rows)
+	require.Equal(t, want.Bytes, got.Bytes)
+	require.Len(t, got.WorkerTimes, 2)
+	require.Len(t, got.Stats, len(want.Stats))
+	for name, w := range want.Stats {
+		g := got.Stats[name]
+		require.InDelta(t, w.M2, g.M2, 1e-6, name)
+		w.M2, g.M2 = 0, 0
+		require.Equal(t, w, g, name)
+	}
+
+	_, err = os.Stat(cpPath)
+	require.ErrorIs(t, err, os.ErrNotExist, "the checkpoint is removed once done")
+}
+
+func TestRunCheckpointMismatch(t *testing.T) {
+	defer func(n int64) { checkpointInterval = n }(checkpointInterval)
+	checkpointInterval = 10
+
+	p := makeFile(t, "stationA;10.00\nstationB;20.00\nstationA;3O.00\n")
+	cpPath := filepath.Join(t.TempDir(), "run.checkpoint")
+	opts := Options{Workers: 1, Checkpoint: cpPath}
+	_, err := Run(context.Background(), []string{p}, opts, nil)
+	require.ErrorIs(t, err, ErrMalformedNumber)
+
+	opts.Median = true
+	_, err = Run(context.Background(), []string{p}, opts, nil)
+	require.ErrorContains(t, err, "was written with different options")
+
+	opts.Median = false
+	_, err = Run(context.Background(), []string{makeFile(t, "stationA;10.00\n")}, opts, nil)
+	require.ErrorContains(t, err, "was written for a different or modified input")
+
+	_, err = Run(context.Background(), []string{p, p}, opts, nil)
+	require.EqualError(t, err, "-checkpoint needs a single input file and no -stream")
+}
+
+func TestRunSumOverflow(t *testing.T) {
+	// A checkpoint as left by resumed runs over tens of trillions of the
+	// hottest possible readings, one short of what fits in Sum.
+	p := makeFile(t, "s;999.99\n")
+	fi, err := os.Stat(p)
+	require.NoError(t, err)
+	abs, err := filepath.Abs(p)
+	require.NoError(t, err)
+	opts := Options{Workers: 1, Checkpoint: filepath.Join(t.TempDir(), "run.checkpoint")}
+	hot := StationStats{Count: maxSafeCount, Min: maxTemp, Max: maxTemp, Sum: maxSafeCount * maxTemp}
+	require.NoError(t, saveCheckpoint(opts.Checkpoint, &checkpoint{
+		Path:    abs,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Options: optionsKey(opts),
+		Stats:   map[string]StationStats{"s": hot},
+	}))
+
+	// One more reading wraps the sum around, which must not go unnoticed.
+	require.Negative(t, hot.Sum+maxTemp)
+	_, err = Run(context.Background(), []string{p}, opts, nil)
+	require.ErrorIs(t, err, ErrSumOverflow)
+	require.EqualError(t, err, fmt.Sprintf(
+		`sum could overflow: station "s" has %d readings, more than the %d whose sum is guaranteed to fit in 64 bits`,
+		int64(maxSafeCount+1), int64(maxSafeCount)))
+
+	require.NoError(t, checkSums(map[string]StationStats{"s": hot}))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted. Inside a container it
+// shows the container's own cgroup, which is the one whose quota matters. It's
+// a variable so tests can point it at a fake tree.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cpuQuota returns the number of CPUs the cgroup CPU quota allows, rounded up,
+// or 0 if there is no quota or it can't be read. cgroup v2 keeps the quota and
+// period in cpu.max, v1 in two files of the cpu controller.
+func cpuQuota() int {
+	if data, err := os.ReadFile(cgroupRoot + "/cpu.max"); err == nil {
+		quota, period, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+		return quotaCPUs(quota, period)
+	}
+	quota, err := os.ReadFile(cgroupRoot + "/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	period, err := os.ReadFile(cgroupRoot + "/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return quotaCPUs(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+// quotaCPUs turns a quota and a period in microseconds into a CPU count. A
+// quota of "max" (v2) or -1 (v1) means unlimited.
+func quotaCPUs(quota, period string) int {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return int(max(1, (q+p-1)/p))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCPUQuota(t *testing.T) {
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	write := func(name, content string) {
+		p := filepath.Join(cgroupRoot, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+	}
+
+	cgroupRoot = t.TempDir()
+	require.Equal(t, 0, cpuQuota(), "no cgroup files")
+	write("cpu.max", "max 100000\n")
+	require.Equal(t, 0, cpuQuota(), "no v2 quota")
+	write("cpu.max", "150000 100000\n")
+	require.Equal(t, 2, cpuQuota(), "1.5 CPUs round up")
+	write("cpu.max", "20000 100000\n")
+	require.Equal(t, 1, cpuQuota(), "at least one CPU")
+
+	cgroupRoot = t.TempDir()
+	write("cpu/cpu.cfs_quota_us", "-1\n")
+	write("cpu/cpu.cfs_period_us", "100000\n")
+	require.Equal(t, 0, cpuQuota(), "no v1 quota")
+	write("cpu/cpu.cfs_quota_us", "400000\n")
+	require.Equal(t, 4, cpuQuota())
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// cpuQuota returns 0: CPU quotas are only read from Linux cgroups.
+func cpuQuota() int {
+	return 0
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"math"
 	"math/rand/v2"
 	"os"
-	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,34 +15,64 @@ import (
 
 type DataGenerator interface {
 	LoadStations(filename string) error
-	Generate(outputFilename string) error
+	Generate(outputFilename string, rows int64) error
 	GetStationCount() int
 }
 
 type BillionRowGenerator struct {
 	stations []string
+	seed     uint64
+	// progress, when not nil, counts the rows written so far.
+	progress *Progress
+	// tempStdDev, when positive, draws each reading from a Gaussian with
+	// this standard deviation around the station's mean instead of uniformly
+	// from -100 to 100.
+	tempStdDev float64
+	// stationMeans makes LoadStations read each station's mean temperature
+	// from the field after its name, as in the reference 1BRC station list.
+	stationMeans bool
+	// means holds the mean temperature of each station, in the order of
+	// stations. Nil means 0 for all of them.
+	means []float64
+	// workers is the number of chunks generated in parallel; 0 means one
+	// per logical CPU.
+	workers int
+	// append makes Generate add its rows to the end of an existing file
+	// instead of replacing it.
+	append bool
 }
 
-const (
-	totalRows = 1_000_000_000
-	chunkSize = 5_000_000
-)
+const defaultRows = 1_000_000_000
+
+// chunkSize is the number of rows generated per chunk. It's a variable so
+// tests can split small outputs into several chunks.
+var chunkSize int64 = 5_000_000
 
+// NewBillionRowGenerator returns a generator seeded from the current time, so
+// every generated file differs.
 func NewBillionRowGenerator() *BillionRowGenerator {
-	return &BillionRowGenerator{}
+	return NewBillionRowGeneratorWithSeed(time.Now().UnixNano())
+}
+
+// NewBillionRowGeneratorWithSeed returns a generator whose output is fully
+// determined by seed and the loaded stations: two runs with the same seed
+// produce byte-identical files.
+func NewBillionRowGeneratorWithSeed(seed int64) *BillionRowGenerator {
+	return &BillionRowGenerator{seed: uint64(seed)}
 }
 
 func (g *BillionRowGenerator) LoadStations(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
-		return fmt.Errorf("error opening stations file: %v", err)
+		return fmt.Errorf("error opening stations file: %w", err)
 	}
 	defer func() { _ = file.Close() }()
 
 	var stations []string
+	var means []float64
 	scanner := bufio.NewScanner(file)
 
-	for scanner.Scan() {
+	for lineNum := 1; scanner.Scan(); lineNum++ {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
@@ -49,13 +81,24 @@ func (g *BillionRowGenerator) LoadStations(filename string) error {
 		if len(parts) > 0 {
 			stations = append(stations, parts[0])
 		}
+		if g.stationMeans {
+			if len(parts) < 2 {
+				return fmt.Errorf("stations file line %d: no mean temperature after the name", lineNum)
+			}
+			mean, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if err != nil {
+				return fmt.Errorf("stations file line %d: invalid mean temperature %q", lineNum, parts[1])
+			}
+			means = append(means, mean)
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading stations file: %v", err)
+		return fmt.Errorf("error reading stations file: %w", err)
 	}
 
 	g.stations = stations
+	g.means = means
 	fmt.Printf("Loaded %d weather stations\n", len(stations))
 	return nil
 }
@@ -70,45 +113,95 @@ func (g *BillionRowGenerator) generateChunk(numRows int, seed1, seed2 uint64) st
 	builder.Grow(numRows * 40)
 
 	for range numRows {
-		station := g.stations[rng.IntN(len(g.stations))]
-		temp := -100.0 + rng.Float64()*200.0 // -100 to 100
-		fmt.Fprintf(&builder, "%s;%.2f\n", station, temp)
+		i := rng.IntN(len(g.stations))
+		fmt.Fprintf(&builder, "%s;%.2f\n", g.stations[i], g.temperature(rng, i))
 	}
 
 	return builder.String()
 }
 
-func (g *BillionRowGenerator) Generate(outputFilename string) error {
+// temperature draws a reading for the station at index i.
+func (g *BillionRowGenerator) temperature(rng *rand.Rand, i int) float64 {
+	if g.tempStdDev <= 0 {
+		return -100.0 + rng.Float64()*200.0 // -100 to 100
+	}
+	mean := 0.0
+	if g.means != nil {
+		mean = g.means[i]
+	}
+	// Clamp the tails so every reading stays within the 1BRC range.
+	return min(max(mean+rng.NormFloat64()*g.tempStdDev, -100), 100)
+}
+
+// Generate writes rows generated rows to outputFilename. Rows are produced in
+// chunks of chunkSize, up to g.workers of them at once; the last chunk holds
+// whatever remains. Every chunk is seeded from its index and g.seed and the
+// chunks are written in order, so the output only depends on the seed, not
+// on the number of workers.
+//
+// With g.append the rows are added to the end of the file, after a newline if
+// the file doesn't end in one, and the file is created if it doesn't exist.
+// The appended rows still only depend on the seed, so appending twice with
+// the same seed adds the same rows twice.
+func (g *BillionRowGenerator) Generate(outputFilename string, rows int64) error {
 	if len(g.stations) == 0 {
 		return fmt.Errorf("no stations loaded - call LoadStations() first")
 	}
+	if rows < 0 {
+		return fmt.Errorf("row count must not be negative, got %d", rows)
+	}
 
-	numChunks := totalRows / chunkSize
-	numWorkers := runtime.NumCPU()
+	numChunks := int((rows + chunkSize - 1) / chunkSize)
+	chunkRows := func(chunkId int) int {
+		return int(min(chunkSize, rows-int64(chunkId)*chunkSize))
+	}
+	g.progress.setTotal(rows)
+	numWorkers := g.workers
+	if numWorkers < 1 {
+		numWorkers, _ = defaultWorkers()
+	}
 
 	fmt.Printf("Generating %d rows using %d workers (%d chunks of %dM rows)\n",
-		totalRows, numWorkers, numChunks, chunkSize/1_000_000)
+		rows, numWorkers, numChunks, chunkSize/1_000_000)
 
-	file, err := os.Create(outputFilename)
+	file, sizeBefore, err := g.openOutput(outputFilename)
 	if err != nil {
-		return fmt.Errorf("error creating output file: %v", err)
+		return err
 	}
 	defer func() { _ = file.Close() }()
 
 	writer := bufio.NewWriterSize(file, 64*1024*1024) // 64MB buffer
 	defer func() { _ = writer.Flush() }()
+	if sizeBefore > 0 {
+		var last [1]byte
+		if _, err := file.ReadAt(last[:], sizeBefore-1); err != nil {
+			return fmt.Errorf("reading end of output file: %w", err)
+		}
+		if last[0] != '\n' {
+			_, _ = writer.WriteString("\n")
+		}
+	}
 
-	output := make(chan string, numWorkers*2)
-	var wgWriter, wg sync.WaitGroup
+	// Every chunk gets its own channel so the writer can emit chunks in
+	// order regardless of which worker finishes first; that keeps the
+	// output deterministic for a given seed. A worker slot is only freed
+	// once its chunk is written, which bounds the chunks held in memory.
+	output := make([]chan string, numChunks)
+	for i := range output {
+		output[i] = make(chan string, 1)
+	}
+	semaphore := make(chan struct{}, numWorkers)
+	var wgWriter sync.WaitGroup
 
 	// Writer goroutine
 	wgWriter.Add(1)
 	go func() {
 		defer wgWriter.Done()
-		chunksWritten := 0
-		for chunk := range output {
-			_, _ = writer.WriteString(chunk)
-			chunksWritten++
+		for i, chunk := range output {
+			_, _ = writer.WriteString(<-chunk)
+			<-semaphore
+			g.progress.add(int64(chunkRows(i)))
+			chunksWritten := i + 1
 			if chunksWritten%10 == 0 {
 				progress := float64(chunksWritten) / float64(numChunks) * 100
 				fmt.Printf("Generated %d/%d chunks (%.1f%%)\n",
@@ -117,33 +210,108 @@ func (g *BillionRowGenerator) Generate(outputFilename string) error {
 		}
 	}()
 
-	semaphore := make(chan struct{}, numWorkers)
 	startTime := time.Now()
 
-	wg.Add(numChunks)
 	for i := range numChunks {
 		semaphore <- struct{}{}
 		go func(chunkId int) {
-			defer func() { wg.Done(); <-semaphore }()
-			output <- g.generateChunk(
-				chunkSize, uint64(chunkId), uint64(time.Now().Unix()),
-			)
+			output[chunkId] <- g.generateChunk(chunkRows(chunkId), uint64(chunkId), g.seed)
 		}(i)
 	}
 
-	wg.Wait()
-	close(output)
 	wgWriter.Wait()
 
 	duration := time.Since(startTime)
 	fmt.Printf("Generation complete in %v\n", duration)
 	fmt.Printf("Generation speed: %.1f million rows/second\n",
-		float64(totalRows)/duration.Seconds()/1_000_000)
+		float64(rows)/duration.Seconds()/1_000_000)
 
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("writing output file: %w", err)
+	}
 	fileInfo, _ := file.Stat()
 	fileSizeGB := float64(fileInfo.Size()) / (1024 * 1024 * 1024)
-	fmt.Printf("Created file: %s (%.1f GB)\n", outputFilename, fileSizeGB)
-	fmt.Printf("Write speed: %.1f GB/second\n", fileSizeGB/duration.Seconds())
+	writtenGB := float64(fileInfo.Size()-sizeBefore) / (1024 * 1024 * 1024)
+	if g.append {
+		fmt.Printf("Appended to file: %s (%.1f GB)\n", outputFilename, fileSizeGB)
+	} else {
+		fmt.Printf("Created file: %s (%.1f GB)\n", outputFilename, fileSizeGB)
+	}
+	fmt.Printf("Write speed: %.1f GB/second\n", writtenGB/duration.Seconds())
 
 	return nil
 }
+
+// openOutput opens the file Generate writes to, truncating it unless g.append
+// is set, and returns it with the size it had before.
+func (g *BillionRowGenerator) openOutput(name string) (*os.File, int64, error) {
+	if !g.append {
+		file, err := os.Create(name)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error creating output file: %w", err)
+		}
+		return file, 0, nil
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening output file: %w", err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, fmt.Errorf("error opening output file: %w", err)
+	}
+	return file, fi.Size(), nil
+}
+
+// Syllables that stationName strings together into made-up place names.
+var (
+	nameOnsets = []string{"b", "br", "ch", "d", "f", "g", "gr", "h", "k", "kr", "l", "m",
+		"n", "p", "r", "s", "sh", "st", "t", "tr", "v", "w", "z"}
+	nameVowels = []string{"a", "e", "i", "o", "u", "ai", "au", "ei", "ou"}
+	nameCodas  = []string{"", "", "", "n", "r", "s", "l", "m", "nd", "rg", "ck"}
+)
+
+// maxGeneratedStations is the most stations GenerateStations writes, ten times
+// the 10,000 the 1BRC rules allow so the limits of the station table can be
+// tested. That is still far fewer than the names stationName can make, so
+// picking unique ones never takes long.
+const maxGeneratedStations = 100_000
+
+// GenerateStations writes a stations file with n made-up stations to
+// outputFilename, one per line as name;mean, with a mean temperature from -30
+// to 30 that -station-means reads. Like Generate, the file only depends on
+// g.seed.
+func (g *BillionRowGenerator) GenerateStations(outputFilename string, n int) error {
+	if n < 1 || n > maxGeneratedStations {
+		return fmt.Errorf("station count must be between 1 and %d, got %d", maxGeneratedStations, n)
+	}
+	// Chunk i of Generate is seeded with (i, g.seed), so this stream is
+	// never the same as one of theirs.
+	rng := rand.New(rand.NewPCG(g.seed, math.MaxUint64))
+	seen := make(map[string]bool, n)
+	return writeFileAtomic(outputFilename, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		for len(seen) < n {
+			name := stationName(rng)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			_, _ = fmt.Fprintf(bw, "%s;%.1f\n", name, -30+rng.Float64()*60)
+		}
+		return bw.Flush()
+	})
+}
+
+// stationName makes up a capitalized name of two to four syllables.
+func stationName(rng *rand.Rand) string {
+	var b strings.Builder
+	for range 2 + rng.IntN(3) {
+		b.WriteString(nameOnsets[rng.IntN(len(nameOnsets))])
+		b.WriteString(nameVowels[rng.IntN(len(nameVowels))])
+	}
+	b.WriteString(nameCodas[rng.IntN(len(nameCodas))])
+	name := b.String()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
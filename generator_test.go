@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateChunkSameSeed(t *testing.T) {
+	stations := []string{"Hamburg", "Bulawayo", "Palembang", "St. John's", "Cracow"}
+
+	a := NewBillionRowGeneratorWithSeed(42)
+	a.stations = stations
+	b := NewBillionRowGeneratorWithSeed(42)
+	b.stations = stations
+	c := NewBillionRowGeneratorWithSeed(43)
+	c.stations = stations
+
+	want := a.generateChunk(1000, 7, a.seed)
+	require.Equal(t, want, b.generateChunk(1000, 7, b.seed))
+	require.NotEqual(t, want, c.generateChunk(1000, 7, c.seed))
+}
+
+func TestGenerateRows(t *testing.T) {
+	dir := t.TempDir()
+	stations := []string{"Hamburg", "Bulawayo", "Palembang"}
+
+	generateFile := func(name string) string {
+		g := NewBillionRowGeneratorWithSeed(1)
+		g.stations = stations
+		path := filepath.Join(dir, name)
+		require.NoError(t, g.Generate(path, 1234))
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	a := generateFile("a.txt")
+	require.Equal(t, 1234, strings.Count(a, "\n"))
+	require.Equal(t, a, generateFile("b.txt"))
+}
+
+func TestGenerateAppend(t *testing.T) {
+	dir := t.TempDir()
+	stations := []string{"Hamburg", "Bulawayo", "Palembang"}
+	generate := func(path string, rows int64, appending bool) {
+		g := NewBillionRowGeneratorWithSeed(3)
+		g.stations = stations
+		g.append = appending
+		require.NoError(t, g.Generate(path, rows))
+	}
+
+	fresh := filepath.Join(dir, "fresh.txt")
+	generate(fresh, 100, false)
+	want, err := os.ReadFile(fresh)
+	require.NoError(t, err)
+
+	// A missing newline at the end of the file is added before the new rows.
+	path := filepath.Join(dir, "data.txt")
+	require.NoError(t, os.WriteFile(path, []byte("Cracow;1.00"), 0o644))
+	generate(path, 100, true)
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "Cracow;1.00\n"+string(want), string(got))
+
+	generate(path, 100, true)
+	got, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "Cracow;1.00\n"+string(want)+string(want), string(got))
+
+	created := filepath.Join(dir, "created.txt")
+	generate(created, 100, true)
+	got, err = os.ReadFile(created)
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(got))
+
+	err = MustRun([]string{"gobillion", "-append", "-f", path}, io.Discard, io.Discard)
+	require.EqualError(t, err, "-append needs -generate")
+}
+
+func TestMustRunGenerateStations(t *testing.T) {
+	dir := t.TempDir()
+	stations := filepath.Join(dir, "stations.txt")
+	require.NoError(t, os.WriteFile(stations, []byte("# comment\nAlpha;1\nBeta\n"), 0o644))
+	out := filepath.Join(dir, "data.txt")
+
+	err := MustRun([]string{"gobillion", "-generate", "-stations", stations,
+		"-f", out, "-rows", "100", "-seed", "1"}, io.Discard, io.Discard)
+	require.NoError(t, err)
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, 100, strings.Count(string(data), "\n"))
+	for line := range strings.Lines(string(data)) {
+		name, _, _ := strings.Cut(line, ";")
+		require.Contains(t, []string{"Alpha", "Beta"}, name)
+	}
+
+	missing := filepath.Join(dir, "missing.txt")
+	err = MustRun([]string{"gobillion", "-generate", "-stations", missing,
+		"-f", filepath.Join(dir, "other.txt")}, io.Discard, io.Discard)
+	require.ErrorIs(t, err, ErrFileNotFound)
+	require.EqualError(t, err, "file not found: stations file "+missing+", pass another with -stations")
+}
+
+func TestGenerateStations(t *testing.T) {
+	dir := t.TempDir()
+	generateStations := func(name string, seed int64) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, NewBillionRowGeneratorWithSeed(seed).GenerateStations(path, 500))
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	a := generateStations("a.txt", 1)
+	require.Equal(t, a, generateStations("b.txt", 1))
+	require.NotEqual(t, a, generateStations("c.txt", 2))
+
+	g := NewBillionRowGeneratorWithSeed(1)
+	g.stationMeans = true
+	require.NoError(t, g.LoadStations(filepath.Join(dir, "a.txt")))
+	require.Equal(t, 500, g.GetStationCount())
+	seen := make(map[string]bool)
+	for i, name := range g.stations {
+		require.False(t, seen[name], "duplicate station %q", name)
+		seen[name] = true
+		require.NotContains(t, name, ";")
+		require.InDelta(t, 0, g.means[i], 30, name)
+	}
+
+	err := g.GenerateStations(filepath.Join(dir, "d.txt"), 0)
+	require.EqualError(t, err, "station count must be between 1 and 100000, got 0")
+}
+
+func TestMustRunGenStations(t *testing.T) {
+	dir := t.TempDir()
+	stations := filepath.Join(dir, "stations.txt")
+	out := filepath.Join(dir, "data.txt")
+
+	err := MustRun([]string{"gobillion", "-gen-stations", "20", "-stations", stations,
+		"-generate", "-f", out, "-rows", "1000", "-seed", "1"}, io.Discard, io.Discard)
+	require.NoError(t, err)
+	list, err := os.ReadFile(stations)
+	require.NoError(t, err)
+	require.Equal(t, 20, strings.Count(string(list), "\n"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, 1000, strings.Count(string(data), "\n"))
+	for line := range strings.Lines(string(data)) {
+		name, _, _ := strings.Cut(line, ";")
+		require.Contains(t, "\n"+string(list), "\n"+name+";")
+	}
+
+	err = MustRun([]string{"gobillion", "-gen-stations", "-1"}, io.Discard, io.Discard)
+	require.EqualError(t, err, "-gen-stations must be between 0 and 100000, got -1")
+}
+
+func TestGenerateGaussian(t *testing.T) {
+	dir := t.TempDir()
+	stationsFile := filepath.Join(dir, "stations.txt")
+	require.NoError(t, os.WriteFile(stationsFile, []byte("Hot;30.5\nCold;-20\n"), 0o644))
+
+	g := NewBillionRowGeneratorWithSeed(7)
+	g.tempStdDev = 5
+	g.stationMeans = true
+	require.NoError(t, g.LoadStations(stationsFile))
+	require.Equal(t, []float64{30.5, -20}, g.means)
+
+	chunk := g.generateChunk(20_000, 0, g.seed)
+	require.Equal(t, chunk, g.generateChunk(20_000, 0, g.seed))
+
+	res, err := Aggregate(context.Background(), chunk, Options{Workers: 1, StdDev: true})
+	require.NoError(t, err)
+	hot, cold := res.Stats["Hot"], res.Stats["Cold"]
+	require.InDelta(t, 30.5, hot.Mean(), 0.2)
+	require.InDelta(t, -20, cold.Mean(), 0.2)
+	require.InDelta(t, 5, hot.StdDev(), 0.2)
+	require.InDelta(t, 5, cold.StdDev(), 0.2)
+
+	require.NoError(t, os.WriteFile(stationsFile, []byte("Hot;30.5\nCold\n"), 0o644))
+	require.EqualError(t, g.LoadStations(stationsFile), "stations file line 2: no mean temperature after the name")
+}
+
+func TestGenerateSameOutputForAnyWorkerCount(t *testing.T) {
+	defer func(n int64) { chunkSize = n }(chunkSize)
+	chunkSize = 100
+
+	dir := t.TempDir()
+	var outputs []string
+	for _, workers := range []int{1, 3, 8} {
+		g := NewBillionRowGeneratorWithSeed(5)
+		g.stations = []string{"Hamburg", "Bulawayo", "Palembang"}
+		g.workers = workers
+		path := filepath.Join(dir, strconv.Itoa(workers)+".txt")
+		require.NoError(t, g.Generate(path, 1234))
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		outputs = append(outputs, string(data))
+	}
+	require.Equal(t, 1234, strings.Count(outputs[0], "\n"))
+	require.Equal(t, outputs[0], outputs[1])
+	require.Equal(t, outputs[0], outputs[2])
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Medians are estimated from a fixed-size histogram of readings per station
+// rather than from every value, so memory stays bounded no matter how many
+// rows a station has. Readings are bucketed every histResolution degrees
+// between histMin and histMax, and anything outside that range is clamped into
+// the first or last bucket. The reported median is therefore accurate to within
+// half a bucket (±0.05°C) when it lies inside the range. Each histogram costs
+// about 8KB and is only allocated, per station per worker, when median tracking
+// is enabled.
+//
+// Like StationStats, the bounds and resolution are in hundredths of a degree.
+const (
+	histMin        = -10_000
+	histMax        = 10_000
+	histResolution = 10
+	histBuckets    = (histMax-histMin)/histResolution + 1
+)
+
+// Histogram counts temperature readings per bucket.
+type Histogram [histBuckets]uint32
+
+// Add records a single reading.
+func (h *Histogram) Add(temp int64) {
+	h[histBucket(temp)]++
+}
+
+// Merge adds the counts of o into h.
+func (h *Histogram) Merge(o *Histogram) {
+	for i, c := range o {
+		h[i] += c
+	}
+}
+
+// Median returns the estimated median, in degrees, of the count readings
+// recorded in h.
+func (h *Histogram) Median(count int64) float64 {
+	lo := h.valueAtRank((count - 1) / 2)
+	hi := h.valueAtRank(count / 2)
+	return degrees(lo+hi) / 2
+}
+
+// valueAtRank returns the bucket value of the reading with the given
+// zero-based rank in ascending order.
+func (h *Histogram) valueAtRank(rank int64) int64 {
+	var seen int64
+	for i, c := range h {
+		seen += int64(c)
+		if seen > rank {
+			return histMin + int64(i)*histResolution
+		}
+	}
+	return histMax
+}
+
+// histBucket returns the bucket whose value is closest to temp.
+func histBucket(temp int64) int {
+	i := (temp - histMin + histResolution/2) / histResolution
+	return int(min(max(i, 0), histBuckets-1))
+}
+
+// The bins printed by -histogram are coarser and exact: reading t lands in bin
+// floor((t - binMin) / binWidth), so bin k covers [binMin + k*binWidth,
+// binMin + (k+1)*binWidth). Readings outside [binMin, binMax) are clamped into
+// the first or last bin, which makes 100.0 count towards the last one. Bins
+// cost 800 bytes per station per worker.
+const (
+	binMin   = -10_000
+	binMax   = 10_000
+	binWidth = 100
+	binCount = (binMax - binMin) / binWidth
+)
+
+// Bins counts temperature readings in 1°C bins from binMin to binMax.
+type Bins [binCount]uint32
+
+// Add records a single reading.
+func (b *Bins) Add(temp int64) {
+	i := floorDiv(temp-binMin, binWidth)
+	b[min(max(i, 0), binCount-1)]++
+}
+
+// Merge adds the counts of o into b.
+func (b *Bins) Merge(o *Bins) {
+	for i, c := range o {
+		b[i] += c
+	}
+}
+
+// String returns the counts separated by commas.
+func (b *Bins) String() string {
+	var sb strings.Builder
+	for i, c := range b {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatUint(uint64(c), 10))
+	}
+	return sb.String()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// adviseMmap tells the kernel how a freshly mapped file will be read. It's a
+// variable so benchmarks can compare runs with and without the hints.
+var adviseMmap = true
+
+// advise hints that b will be read from start to end, soon. MADV_SEQUENTIAL
+// makes readahead more aggressive for each worker's sequential scan of its
+// chunks, and MADV_WILLNEED starts reading the whole file into the page cache
+// right away instead of on the first fault of every page. Both are hints only:
+// errors are ignored, as the file is still read correctly without them.
+func advise(b []byte) {
+	if !adviseMmap {
+		return
+	}
+	_ = syscall.Madvise(b, syscall.MADV_SEQUENTIAL)
+	_ = syscall.Madvise(b, syscall.MADV_WILLNEED)
+}
+
+// cached reports whether all of data is in the page cache, as told by
+// mincore. It errs on the side of false when mincore fails.
+func cached(data string) bool {
+	if len(data) == 0 {
+		return true
+	}
+	page := uintptr(os.Getpagesize())
+	start := uintptr(unsafe.Pointer(unsafe.StringData(data)))
+	aligned := start &^ (page - 1)
+	pages := (start + uintptr(len(data)) - aligned + page - 1) / page
+	vec := make([]byte, pages)
+	_, _, errno := syscall.Syscall(syscall.SYS_MINCORE,
+		aligned, pages*page, uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return false
+	}
+	for _, v := range vec {
+		if v&1 == 0 {
+			return false
+		}
+	}
+	return true
+}
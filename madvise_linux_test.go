@@ -0,0 +1,88 @@
+//go:build amd64 || arm64
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// dropCache evicts the file from the page cache with
+// posix_fadvise(POSIX_FADV_DONTNEED), so that the next read of it goes to disk.
+func dropCache(tb testing.TB, file *os.File) {
+	tb.Helper()
+	if err := file.Sync(); err != nil {
+		tb.Fatal(err)
+	}
+	const fadvDontNeed = 4
+	if _, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, fadvDontNeed, 0, 0); errno != 0 {
+		tb.Fatal(errno)
+	}
+}
+
+func TestPrefaultColdFile(t *testing.T) {
+	data := benchmarkData()
+	want, err := Aggregate(context.Background(), data, Options{Workers: 3})
+	require.NoError(t, err)
+
+	file, err := os.Open(makeFile(t, data))
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+	dropCache(t, file)
+	mapped, cleanup, err := mmapFile(file)
+	require.NoError(t, err)
+	defer cleanup()
+	if cached(mapped) {
+		t.Skip("the file stayed in the page cache")
+	}
+
+	got, err := Aggregate(context.Background(), mapped, Options{Workers: 3, Prefault: true})
+	require.NoError(t, err)
+	require.Equal(t, want.Stats, got.Stats)
+	require.True(t, cached(mapped), "every page has been read")
+}
+
+// BenchmarkMmapColdCache aggregates a 64MB file through mmapFile without
+// help, with madvise hints and with -prefault. Before every run the file is
+// dropped from the page cache, so each run reads it from disk as the first run
+// on a big file would.
+func BenchmarkMmapColdCache(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "measurements.txt")
+	data := strings.Repeat(benchmarkData(), 16)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	for _, mode := range []string{"plain", "advise", "prefault"} {
+		b.Run(mode, func(b *testing.B) {
+			defer func(a bool) { adviseMmap = a }(adviseMmap)
+			adviseMmap = mode == "advise"
+			opts := Options{Workers: 4, Prefault: mode == "prefault"}
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				b.StopTimer()
+				file, err := os.Open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				dropCache(b, file)
+				b.StartTimer()
+
+				mapped, cleanup, err := mmapFile(file)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := Aggregate(context.Background(), mapped, opts); err != nil {
+					b.Fatal(err)
+				}
+				cleanup()
+				_ = file.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+// advise does nothing: the syscall package only has madvise on Linux.
+func advise(b []byte) {}
+
+// cached always reports false: without mincore there is no telling whether
+// the data is in the page cache, so -prefault always runs.
+func cached(data string) bool {
+	return false
+}
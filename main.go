@@ -1,156 +1,1560 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"math/bits"
 	"os"
+	"os/signal"
+	"regexp"
 	"runtime"
 	"runtime/pprof"
-	"sort"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/sync/errgroup"
 )
 
+// StationStats holds the aggregates of a single station. Temperatures are
+// kept as fixed-point hundredths of a degree so that summing never accumulates
+// floating-point rounding error; use Mean and degrees to convert.
 type StationStats struct {
-	Count int64
-	Min   float64
-	Max   float64
-	Sum   float64
+	Count  int64
+	Min    int64
+	Max    int64
+	Sum    int64
+	Hist   *Histogram // nil unless median tracking is enabled
+	Bins   *Bins      // nil unless Options.Histogram is set
+	Sample *Sample    // nil unless Options.Sample is set
+	// M2 is the sum of squared deviations from the mean, maintained with
+	// Welford's online algorithm when standard deviation tracking is enabled.
+	// Unlike a plain sum of squares it doesn't suffer from catastrophic
+	// cancellation for stations with many readings and a small variance.
+	M2 float64
+	// First and Last are the one-based line numbers of the station's first
+	// and last record in the input. They are zero unless Options.Provenance
+	// is set.
+	First int64
+	Last  int64
 }
 
+// Mean returns the average temperature in degrees.
+func (s *StationStats) Mean() float64 {
+	return float64(s.Sum) / (float64(s.Count) * 100)
+}
+
+// StdDev returns the population standard deviation of the readings.
+func (s *StationStats) StdDev() float64 {
+	return math.Sqrt(s.M2 / float64(s.Count))
+}
+
+// init sets s to hold the single reading temp, allocating the histograms
+// opts asks for.
+func (s *StationStats) init(temp int64, opts *Options) {
+	*s = StationStats{
+		Min:   temp,
+		Max:   temp,
+		Sum:   temp,
+		Count: 1,
+	}
+	if opts.Median {
+		s.Hist = new(Histogram)
+		s.Hist.Add(temp)
+	}
+	if opts.Histogram {
+		s.Bins = new(Bins)
+		s.Bins.Add(temp)
+	}
+	if opts.Sample > 0 {
+		s.Sample = newSample(opts.Sample)
+	}
+}
+
+// add records another reading in s, which must have been set up by init.
+func (s *StationStats) add(temp int64, stddev bool) {
+	if stddev {
+		s.M2 += welfordDelta(s, temp)
+	}
+	s.Min = min(s.Min, temp)
+	s.Max = max(s.Max, temp)
+	s.Sum += temp
+	s.Count++
+	if s.Hist != nil {
+		s.Hist.Add(temp)
+	}
+	if s.Bins != nil {
+		s.Bins.Add(temp)
+	}
+}
+
+// reading is a parsed record as far as the optional per-record tracking
+// needs it.
+type reading struct {
+	temp int64
+	line int64  // for Options.Provenance
+	key  uint64 // for Options.Sample
+}
+
+// track does the optional bookkeeping for r after it has been added to s.
+func (s *StationStats) track(r reading, opts *Options) {
+	if opts.Provenance {
+		s.seen(r.line)
+	}
+	if s.Sample != nil {
+		s.Sample.Add(r.key, r.temp)
+	}
+}
+
+// seen records that the station has a record on line, widening First and
+// Last as needed. Lines may come in any order.
+func (s *StationStats) seen(line int64) {
+	if s.First == 0 || line < s.First {
+		s.First = line
+	}
+	s.Last = max(s.Last, line)
+}
+
+// Range returns the difference between the highest and lowest reading in
+// degrees.
+func (s *StationStats) Range() float64 {
+	return degrees(s.Max - s.Min)
+}
+
+// maxTemp is the magnitude of the most extreme reading parseTemp accepts,
+// 999.99 degrees, in hundredths.
+const maxTemp = 99_999
+
+// maxSafeCount is the most readings a station can have while its Sum is
+// guaranteed not to overflow an int64, whatever the readings are: about 92
+// trillion.
+const maxSafeCount = math.MaxInt64 / maxTemp
+
+// checkSums returns an error if a station has more than maxSafeCount readings,
+// in which case its Sum may have wrapped around. No single input comes close,
+// but stats merged over many inputs or resumed runs could. As |Sum| is at most
+// Count times maxTemp, Sum can only overflow once Count is past maxSafeCount,
+// which is still far from overflowing itself, so checking the counts once at
+// the end catches every overflow and keeps a check out of the per-row loop.
+// It errs on the side of an error for a station with that many readings whose
+// sum happens to fit.
+func checkSums(stats map[string]StationStats) error {
+	for name, s := range stats {
+		if s.Count > maxSafeCount {
+			return fmt.Errorf(
+				"%w: station %q has %d readings, more than the %d whose sum is guaranteed to fit in 64 bits",
+				ErrSumOverflow, name, s.Count, int64(maxSafeCount))
+		}
+	}
+	return nil
+}
+
+// welfordDelta returns how much M2 grows when temp is added to s. It must be
+// called before temp is added to Sum and Count.
+func welfordDelta(s *StationStats, temp int64) float64 {
+	x := degrees(temp)
+	mean := s.Mean()
+	newMean := float64(s.Sum+temp) / (float64(s.Count+1) * 100)
+	return (x - mean) * (x - newMean)
+}
+
+// mergeM2 returns the M2 of the union of a and b, using the parallel variant
+// of Welford's algorithm by Chan et al.
+func mergeM2(a, b *StationStats) float64 {
+	delta := b.Mean() - a.Mean()
+	n := float64(a.Count + b.Count)
+	return a.M2 + b.M2 + delta*delta*float64(a.Count)*float64(b.Count)/n
+}
+
+// Options configures Aggregate.
+type Options struct {
+	// Workers is the number of chunks processed in parallel.
+	Workers int
+	// Median enables the per-station histogram used to estimate medians.
+	Median bool
+	// StdDev enables tracking of M2 for standard deviations.
+	StdDev bool
+	// Histogram enables the per-station 1°C Bins.
+	Histogram bool
+	// SkipMalformed makes records with an unparsable temperature count
+	// towards Result.Malformed instead of aborting the run.
+	SkipMalformed bool
+	// AllowSpecial does the same as SkipMalformed for NaN and infinite
+	// temperatures only; any other malformed record is still an error.
+	AllowSpecial bool
+	// Filter, when not nil, restricts aggregation to stations whose name
+	// matches it. Matching is cached per distinct name in each chunk, so the
+	// regexp only runs once per station per worker and the steady-state cost
+	// is a map lookup per row. A nil Filter matches everything at no cost.
+	Filter *regexp.Regexp
+	// Delim separates the station name from the temperature. Zero means
+	// ';', as in the 1BRC format.
+	Delim byte
+	// DecimalSep is the decimal point of the temperatures. Zero means '.';
+	// locales that write 12,34 use ','.
+	DecimalSep byte
+	// Comment, when not zero, makes lines whose first byte other than spaces
+	// and tabs is Comment be skipped as comments. They still count for line
+	// numbers.
+	Comment byte
+	// SkipHeader ignores the first line of every input file, such as a
+	// "station;temperature" header. The line still counts for line numbers.
+	SkipHeader bool
+	// TempCol is the column holding the temperature, the station name being
+	// column 0. Zero means 1, the 1BRC layout of a name and a temperature.
+	// Other columns are ignored, but a record with fewer columns than
+	// TempCol is malformed.
+	TempCol int
+	// Validate only checks that every record parses: no stats are kept, so
+	// Result.Stats is empty.
+	Validate bool
+	// Shared makes the workers of Aggregate write into one concurrent map
+	// with striped locks instead of a table each that is merged at the end.
+	Shared bool
+	// Stream makes aggregateFiles read files in blocks that are handed to
+	// a pool of workers instead of memory-mapping them.
+	Stream bool
+	// Sample, when positive, keeps a uniform random sample of up to that
+	// many readings per station in StationStats.Sample. The sample only
+	// depends on SampleSeed and the input, not on the number of workers.
+	Sample     int
+	SampleSeed uint64
+	// Fold lowercases station names before aggregating them, so names that
+	// only differ in case are merged under the lowercase form. Filter then
+	// sees the lowercase names too.
+	Fold bool
+	// Provenance tracks the first and last line of every station in
+	// StationStats.First and Last. Line numbers are global, so Aggregate has
+	// to count the lines of the input before processing it.
+	Provenance bool
+	// Checkpoint, when set, is the path of a checkpoint file that Run resumes
+	// from and saves its progress to. It is only supported for a single file
+	// that can be memory-mapped; see checkpoint.
+	Checkpoint string
+	// Window makes aggregateFiles map files mapWindow bytes at a time and
+	// process one window after another instead of mapping each file whole,
+	// so files larger than the address space can still be mapped. Files too
+	// large to map whole are always mapped this way.
+	Window bool
+	// Prefault touches the pages of memory-mapped input in a background
+	// goroutine ahead of the workers, so they don't stall on page faults
+	// while the file is read from disk. It has no effect on other inputs.
+	Prefault bool
+	// Progress, when not nil, receives the number of input bytes consumed
+	// as workers go.
+	Progress *Progress
+	// Repeat, when more than 1, makes Run aggregate its input files that many
+	// times over while keeping them open and mapped, and report how long
+	// every run took in RunResult.Runs. The result is that of the first run;
+	// the others are only timed. The input files must be memory-mapped whole.
+	Repeat int
+	// LimitBytes, when positive, makes Run process only the first LimitBytes
+	// bytes of every input and the rest of the record the last of them is
+	// in, and nothing past it. Result.Bytes counts the bytes processed.
+	LimitBytes int64
+	// Explain, when not nil, receives a description of the execution plan
+	// before processing starts: how every input is read and the chunks the
+	// mapped ones are split into.
+	Explain io.Writer
+
+	shared    *sharedStats // set by aggregateAll when Shared is set
+	firstLine int64        // line number of a chunk's first record, with Provenance
+	offset    int64        // of the chunk's data in the input, for sample keys
+	header    bool         // the chunk starts a file, whose first line is skipped with SkipHeader
+}
+
+// explainf writes a line of the execution plan to o.Explain, if set.
+func (o Options) explainf(format string, args ...any) {
+	if o.Explain == nil {
+		return
+	}
+	_, _ = fmt.Fprint(o.Explain, "Plan: ")
+	_, _ = fmt.Fprintf(o.Explain, format, args...)
+	_, _ = fmt.Fprintln(o.Explain)
+}
+
+func (o Options) delim() byte {
+	if o.Delim == 0 {
+		return ';'
+	}
+	return o.Delim
+}
+
+func (o Options) decimalSep() byte {
+	if o.DecimalSep == 0 {
+		return '.'
+	}
+	return o.DecimalSep
+}
+
+// parseDecimalSep parses the value of the -decimal-sep flag, a single byte
+// that can't be part of a number and differs from delim, or records such as
+// "Paris,12,34" would be ambiguous.
+func parseDecimalSep(s string, delim byte) (byte, error) {
+	if len(s) != 1 || s[0] >= '0' && s[0] <= '9' || s[0] == '-' || s[0] == '+' || s[0] == '\n' || s[0] == '\r' {
+		return 0, fmt.Errorf("-decimal-sep must be a single byte other than a digit, a sign or a line break, got %q", s)
+	}
+	if s[0] == delim {
+		return 0, fmt.Errorf("-decimal-sep and -delim must differ, both are %q", s)
+	}
+	return s[0], nil
+}
+
+// parseComment parses the value of the -comment flag: empty for no comments,
+// or a single byte that can't be confused with the record syntax.
+func parseComment(s string, delim byte) (byte, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if len(s) != 1 || s[0] == '\n' || s[0] == '\r' || s[0] == ' ' || s[0] == '\t' || s[0] == delim {
+		return 0, fmt.Errorf("-comment must be a single byte other than a line break, a blank or -delim, got %q", s)
+	}
+	return s[0], nil
+}
+
+// parseDelim parses the value of the -delim flag, which must be a single byte
+// other than a line break. A literal \t is accepted for tab.
+func parseDelim(s string) (byte, error) {
+	if s == `\t` {
+		return '\t', nil
+	}
+	if len(s) != 1 || s[0] == '\n' || s[0] == '\r' {
+		return 0, fmt.Errorf("-delim must be a single byte other than a line break, got %q", s)
+	}
+	return s[0], nil
+}
+
+// Result is the outcome of aggregating a data set.
+type Result struct {
+	// Stats holds the merged stats keyed by station name.
+	Stats map[string]StationStats
+	// Rows is the number of records parsed, including records of stations
+	// excluded by Options.Filter.
+	Rows int64
+	// Malformed is the number of records skipped because they couldn't be
+	// parsed. It is always zero unless Options.SkipMalformed or
+	// Options.AllowSpecial is set.
+	Malformed int64
+	// Bytes is the number of bytes of input consumed.
+	Bytes int64
+	// WorkerTimes holds the wall-clock time each worker spent processing
+	// chunks, to show how evenly the work was spread.
+	WorkerTimes []time.Duration
+}
+
+// chunkResult is what a single worker reports back for its chunk.
+type chunkResult struct {
+	stats     *stationTable
+	rows      int64
+	malformed int64
+	bytes     int64         // of the chunk got through, all of it unless canceled
+	duration  time.Duration // wall-clock time spent in processChunk
+}
+
+// degrees converts a fixed-point temperature in hundredths to degrees.
+func degrees(v int64) float64 {
+	return float64(v) / 100
+}
+
+// printOptions controls how printResults renders the merged stats.
+type printOptions struct {
+	format string
+	median bool
+	stddev bool
+	counts bool   // append the row count in the brace format
+	top    int    // print only the top stations by count when > 0
+	sort   string // sortName, sortCount, sortMean, sortMeanDesc or sortRange
+	unit   string // unitCelsius or unitFahrenheit
+
+	// minCount omits stations with fewer rows; it applies before top.
+	minCount int64
+	// tempRange appends max-min after the standard deviation.
+	tempRange bool
+	// histogram prints the 1°C bins of every station: a line per station
+	// after the brace output, or a field in JSON.
+	histogram bool
+	// provenance prints the first and last line of every station.
+	provenance bool
+	// sample prints the sampled readings of every station: a line per
+	// station after the brace output, or a field in JSON.
+	sample bool
+	// brcRounding rounds temperatures half up as in the reference 1BRC
+	// implementation.
+	brcRounding bool
+	// precision is the number of decimals printed, from 0 to maxPrecision.
+	precision int
+}
+
+const (
+	unitCelsius    = "C"
+	unitFahrenheit = "F"
+)
+
+// Temperatures are printed with defaultPrecision decimals, or one with
+// -brc-rounding, unless -precision says otherwise. More than maxPrecision
+// would only print noise: readings have two decimals and means are exact.
+const (
+	defaultPrecision = 2
+	maxPrecision     = 6
+)
+
+// temp converts a temperature in degrees Celsius to the output unit. Stats
+// are always accumulated in Celsius and only converted here, at print time.
+func (o printOptions) temp(c float64) float64 {
+	if o.unit == unitFahrenheit {
+		return c*9/5 + 32
+	}
+	return c
+}
+
+// formatTemp formats a temperature in degrees Celsius in the output unit,
+// with precision decimals. With brcRounding the last digit is rounded half up
+// (towards positive infinity) like Java's Math.round in the reference 1BRC
+// implementation, where strconv rounds half to even.
+func (o printOptions) formatTemp(c float64) string {
+	v := o.temp(c)
+	if o.brcRounding {
+		scale := math.Pow10(o.precision)
+		v = math.Floor(v*scale+0.5) / scale
+	}
+	return strconv.FormatFloat(v, 'f', o.precision, 64)
+}
+
+// exactTemp formats the temperature num/den, in hundredths of a degree
+// Celsius, like formatTemp. In Celsius brcRounding is done in integers, so
+// values with no exact binary representation, like a mean of 0.15, still round
+// half up instead of being nudged either way by float error.
+func (o printOptions) exactTemp(num, den int64) string {
+	if o.brcRounding && o.unit == unitCelsius {
+		// Rescale num/den from hundredths to units of the last printed digit;
+		// at most 10^4 for precision 6, which leaves plenty of headroom.
+		if o.precision >= 2 {
+			num *= pow10(o.precision - 2)
+		} else {
+			den *= pow10(2 - o.precision)
+		}
+		return formatFixed(floorDiv(2*num+den, 2*den), o.precision)
+	}
+	return o.formatTemp(float64(num) / (float64(den) * 100))
+}
+
+// formatSpread formats a temperature difference, such as a standard
+// deviation, in the output unit with precision decimals.
+func (o printOptions) formatSpread(c float64) string {
+	return strconv.FormatFloat(o.spread(c), 'f', o.precision, 64)
+}
+
+// formatSample formats the readings of s in ascending order, separated by
+// commas.
+func (o printOptions) formatSample(s *Sample) string {
+	var sb strings.Builder
+	for i, v := range s.Values() {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(o.exactTemp(v, 1))
+	}
+	return sb.String()
+}
+
+// formatFixed formats a fixed-point value with the given number of decimals.
+func formatFixed(v int64, decimals int) string {
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	digits := strconv.FormatInt(v, 10)
+	if decimals == 0 {
+		return sign + digits
+	}
+	if len(digits) <= decimals {
+		digits = strings.Repeat("0", decimals-len(digits)+1) + digits
+	}
+	point := len(digits) - decimals
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// pow10 returns 10^n for n >= 0.
+func pow10(n int) int64 {
+	v := int64(1)
+	for range n {
+		v *= 10
+	}
+	return v
+}
+
+// floorDiv divides a by b > 0, rounding towards negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// spread converts a temperature difference, such as a standard deviation,
+// to the output unit. Unlike temp it has no offset.
+func (o printOptions) spread(c float64) float64 {
+	if o.unit == unitFahrenheit {
+		return c * 9 / 5
+	}
+	return c
+}
+
+// stdin is the input used when the data is piped in instead of read from a
+// file. It's a variable so tests can substitute it.
+var stdin = os.Stdin
+
+// errInterrupted is returned by MustRun after printing the partial results of
+// a run stopped with Ctrl-C.
+var errInterrupted = errors.New("interrupted, the results only cover part of the input")
+
+// exitInterrupted is the exit code after errInterrupted, 128 plus the number of
+// SIGINT as shells report it, so scripts can tell partial results apart from
+// a failed run.
+const exitInterrupted = 130
+
 func main() {
 	if err := MustRun(os.Args, os.Stdout, os.Stderr); err != nil {
 		fmt.Fprint(os.Stderr, err.Error())
+		if errors.Is(err, errInterrupted) {
+			os.Exit(exitInterrupted)
+		}
 		os.Exit(1)
 	}
 }
 
 func MustRun(args []string, stdout, stderr io.Writer) error {
 	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
-	fWorkers := flags.Int("w", 0, "workers (default: num of logical CPUs)")
-	fFile := flags.String("f", "data.txt", "path to data txt file")
+	fWorkers := flags.Int("w", 0, "workers (default: GOMAXPROCS, capped by the cgroup CPU quota)")
+	fFile := flags.String("f", "data.txt", "path to data txt file, comma-separated for several, - for stdin")
 	fProfileMem := flags.String("profmem", "", "generate memory profile file")
 	fProfileCPU := flags.String("profcpu", "", "generate CPU profile file")
 	fGenerate := flags.Bool("generate", false, "generate the data file")
+	fRows := flags.Int64("rows", defaultRows, "number of rows for -generate")
+	fStations := flags.String("stations", defaultStationsFile, "station list for -generate, one name per line")
+	fGenStations := flags.Int("gen-stations", 0, "write N made-up stations with mean temperatures to the -stations file, before -generate if given")
+	fTempStdDev := flags.Float64("temp-stddev", 0, "generate readings from a Gaussian with this stddev around each station's mean (default: uniform from -100 to 100)")
+	fAppend := flags.Bool("append", false, "add the -generate rows to the end of the file instead of overwriting it")
+	fStationMeans := flags.Bool("station-means", false, "read each station's mean temperature for -temp-stddev from the field after its name in -stations")
+	fSeed := flags.Int64("seed", 0, "random seed for -generate and -sample; the same seed produces the same file or sample (default: time-based)")
+	fFormat := flags.String("format", formatBRC, "output format: brc, json, ndjson or csv")
+	fMedian := flags.Bool("median", false, "also print the (approximate) median per station")
+	fStdDev := flags.Bool("stddev", false, "also print the standard deviation per station")
+	fSkipMalformed := flags.Bool("skip-malformed", false, "skip and count malformed rows instead of failing")
+	fAllowSpecial := flags.Bool("allow-special", false, "skip and count NaN and infinite temperatures instead of failing")
+	fTop := flags.Int("top", 0, "only print the N stations with the most rows")
+	fSort := flags.String("sort", sortName, "station order: name, count, mean, mean-desc or range (default with -top: count)")
+	fMinCount := flags.Int64("min-count", 0, "only print stations with at least N rows")
+	fRange := flags.Bool("range", false, "also print the temperature range (max-min) per station")
+	fBRCRounding := flags.Bool("brc-rounding", false, "print temperatures with one decimal rounded half up, as the reference 1BRC does")
+	fHistogram := flags.Bool("histogram", false, "also print per-station counts in 1°C bins from -100 to 100")
+	fCounts := flags.Bool("counts", false, "also print the row count per station")
+	fPrecision := flags.Int("precision", defaultPrecision, "number of decimals printed, 0 to 6 (default with -brc-rounding: 1)")
+	fProvenance := flags.Bool("provenance", false, "also print the first and last line number of every station")
+	fSample := flags.Int("sample", 0, "keep and print a random sample of N readings per station, fixed by -seed")
+	fFold := flags.Bool("fold", false, "merge station names that only differ in case, printing them in lowercase")
+	fStation := flags.String("station", "", "aggregate everything but only print this station, failing if it isn't there")
+	fFilter := flags.String("filter", "", "only aggregate stations matching this regexp")
+	fOutput := flags.String("o", "", "write results to this file instead of stdout")
+	fGzipOut := flags.Bool("gzip-out", false, "gzip-compress the results written to stdout or -o")
+	fUnit := flags.String("unit", unitCelsius, "temperature unit for output: C or F")
+	fExtremes := flags.Bool("extremes", false, "print the lowest and highest reading across all stations")
+	fMetrics := flags.String("metrics", "", "write the rows, stations, bytes and duration of the run to this file as Prometheus metrics")
+	fMemStats := flags.Bool("memstats", false, "print the heap in use after merging and the peak heap size")
+	fTiming := flags.Bool("timing", false, "print the min/mean/max time the workers spent processing")
+	fProgress := flags.Bool("progress", false, "print progress to stderr every second")
+	fShared := flags.Bool("shared", false, "aggregate into one map with striped locks instead of a map per worker")
+	fCheckpoint := flags.String("checkpoint", "", "save progress to this file and resume from it on the next run")
+	fPrefault := flags.Bool("prefault", false, "touch the pages of mapped files in the background ahead of the workers")
+	fWindow := flags.Bool("window", false, "map files 1GB at a time instead of whole, for files larger than the address space")
+	fStream := flags.Bool("stream", false, "read files in blocks handed to the workers instead of memory-mapping them")
+	fValidate := flags.Bool("validate", false, "only check that every record parses, without aggregating")
+	fLimitBytes := flags.Int64("limit-bytes", 0, "process only the first N bytes of every input, up to the end of the record they stop in (0 for all of it)")
+	fRepeat := flags.Int("repeat", 1, "aggregate the input N times over with the files kept mapped, printing the first result and the min/median/max time")
+	fExplain := flags.Bool("explain", false, "print how the input is read and split into chunks to stderr before processing")
+	fVersion := flags.Bool("version", false, "print version information and exit")
+	fDelim := flags.String("delim", ";", "single-byte separator between station name and temperature")
+	fDecimalSep := flags.String("decimal-sep", ".", "single-byte decimal point of the temperatures, such as , for 12,34")
+	fComment := flags.String("comment", "", "skip lines starting with this byte, after any blanks (default: none)")
+	fSkipHeader := flags.Bool("skip-header", false, "ignore the first line of every input file")
+	fTempCol := flags.Int("temp-col", 1, "column holding the temperature, the station name being column 0")
+	fLogLevel := flags.String("log-level", "info", "least severe diagnostics logged to stderr: error, warn, info or debug")
 	if err := flags.Parse(args[1:]); err != nil {
 		return err
 	}
+	setFlags := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	if *fVersion {
+		_, _ = fmt.Fprint(stdout, versionString())
+		return nil
+	}
+
+	// Notes on how the run goes are logged as records that scripts can parse;
+	// the results and the reports asked for by flags are printed as they are.
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*fLogLevel)); err != nil {
+		return fmt.Errorf("-log-level must be error, warn, info or debug, got %q", *fLogLevel)
+	}
+	logger := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level}))
+
+	if _, ok := resultWriters[*fFormat]; !ok {
+		return fmt.Errorf("unknown output format %q", *fFormat)
+	}
+	switch *fUnit {
+	case unitCelsius, unitFahrenheit:
+	default:
+		return fmt.Errorf("unknown unit %q, want C or F", *fUnit)
+	}
+	if *fRows < 0 {
+		return fmt.Errorf("-rows must not be negative, got %d", *fRows)
+	}
+	if *fTempStdDev < 0 || math.IsNaN(*fTempStdDev) {
+		return fmt.Errorf("-temp-stddev must not be negative, got %v", *fTempStdDev)
+	}
+	if *fStationMeans && *fTempStdDev == 0 {
+		return fmt.Errorf("-station-means needs -temp-stddev")
+	}
+	if *fGenStations < 0 || *fGenStations > maxGeneratedStations {
+		return fmt.Errorf("-gen-stations must be between 0 and %d, got %d", maxGeneratedStations, *fGenStations)
+	}
+	if *fAppend && !*fGenerate {
+		return fmt.Errorf("-append needs -generate")
+	}
+	if *fHistogram && *fFormat == formatCSV {
+		return fmt.Errorf("-histogram is not supported with -format csv")
+	}
+	if *fSample < 0 {
+		return fmt.Errorf("-sample must not be negative, got %d", *fSample)
+	}
+	if *fSample > 0 && *fFormat == formatCSV {
+		return fmt.Errorf("-sample is not supported with -format csv")
+	}
+	if *fPrecision < 0 || *fPrecision > maxPrecision {
+		return fmt.Errorf("-precision must be between 0 and %d, got %d", maxPrecision, *fPrecision)
+	}
+	if *fBRCRounding && !setFlags["precision"] {
+		*fPrecision = 1 // the reference 1BRC prints one decimal
+	}
+	if *fTop < 0 {
+		return fmt.Errorf("-top must not be negative, got %d", *fTop)
+	}
+	if *fMinCount < 0 {
+		return fmt.Errorf("-min-count must not be negative, got %d", *fMinCount)
+	}
+	switch *fSort {
+	case sortName, sortCount, sortMean, sortMeanDesc, sortRange:
+	default:
+		return fmt.Errorf("unknown sort mode %q", *fSort)
+	}
+	if *fTop > 0 && !setFlags["sort"] {
+		*fSort = sortCount // -top lists the busiest stations first
+	}
+	delim, err := parseDelim(*fDelim)
+	if err != nil {
+		return err
+	}
+	comment, err := parseComment(*fComment, delim)
+	if err != nil {
+		return err
+	}
+	decimalSep, err := parseDecimalSep(*fDecimalSep, delim)
+	if err != nil {
+		return err
+	}
+	if *fLimitBytes < 0 {
+		return fmt.Errorf("-limit-bytes must not be negative, got %d", *fLimitBytes)
+	}
+	if *fRepeat < 1 {
+		return fmt.Errorf("-repeat must be at least 1, got %d", *fRepeat)
+	}
+	if *fTempCol < 1 {
+		return fmt.Errorf("-temp-col must be at least 1, column 0 is the station name")
+	}
+	var filter *regexp.Regexp
+	if *fFilter != "" {
+		if filter, err = regexp.Compile(*fFilter); err != nil {
+			return fmt.Errorf("compiling -filter: %w", err)
+		}
+	}
 
+	workersFrom := "-w"
 	if *fWorkers == 0 {
-		*fWorkers = runtime.NumCPU()
+		*fWorkers, workersFrom = defaultWorkers()
+	}
+	paths := strings.Split(*fFile, ",")
+	if !setFlags["f"] && stdinIsPipe() {
+		paths = []string{"-"}
+	}
+	if !*fGenerate && *fGenStations == 0 {
+		if size := inputSize(paths); size >= 0 {
+			if workers := capWorkers(*fWorkers, size); workers < *fWorkers {
+				logger.Info("Reducing workers for a small input",
+					"from", *fWorkers, "to", workers, "bytes", size)
+				*fWorkers = workers
+			}
+		}
 	}
 
 	if *fProfileCPU != "" {
 		f, err := os.Create(*fProfileCPU)
 		if err != nil {
-			return fmt.Errorf("creating CPU profile file: %v", err)
+			return fmt.Errorf("creating CPU profile file: %w", err)
 		}
 		if err := pprof.StartCPUProfile(f); err != nil {
-			return fmt.Errorf("starting CPU profiler: %v", err)
+			return fmt.Errorf("starting CPU profiler: %w", err)
 		}
 		defer func() {
 			pprof.StopCPUProfile()
 			_ = f.Close()
 		}()
 	}
+	// The heap profile is written once processing is done, but the file is
+	// created up front so a bad path fails before a long run.
+	var memProfile *os.File
 	if *fProfileMem != "" {
-		f, err := os.Create("mem.prof")
-		if err != nil {
-			return fmt.Errorf("creating memory profile file: %v", err)
+		var err error
+		if memProfile, err = os.Create(*fProfileMem); err != nil {
+			return fmt.Errorf("creating memory profile file: %w", err)
+		}
+		defer func() { _ = memProfile.Close() }()
+	}
+
+	logger.Info("Billion row challenge go version")
+	logger.Info("Using parallel workers", "workers", *fWorkers, "source", workersFrom)
+
+	if *fGenerate || *fGenStations > 0 {
+		generator := NewBillionRowGenerator()
+		if setFlags["seed"] {
+			generator = NewBillionRowGeneratorWithSeed(*fSeed)
+		}
+		if *fGenStations > 0 {
+			if err := generateStations(generator, *fStations, *fGenStations); err != nil {
+				return err
+			}
+			if !*fGenerate {
+				return nil
+			}
+		}
+		generator.workers = *fWorkers
+		generator.tempStdDev = *fTempStdDev
+		generator.stationMeans = *fStationMeans
+		generator.append = *fAppend
+		if *fProgress {
+			generator.progress = new(Progress)
+			stop := reportProgress(logger, "Generating", "rows", generator.progress, time.Second)
+			defer stop()
+		}
+		return generate(generator, *fStations, *fFile, *fRows)
+	}
+
+	// Create the output file up front so a bad path fails before a long run.
+	var outFile *os.File
+	if *fOutput != "" {
+		var err error
+		if outFile, err = os.Create(*fOutput); err != nil {
+			return fmt.Errorf("creating output file: %w", err)
+		}
+		defer func() { _ = outFile.Close() }()
+		stdout = outFile
+	}
+	var gzipOut *gzip.Writer
+	if *fGzipOut {
+		gzipOut = gzip.NewWriter(stdout)
+		stdout = gzipOut
+	}
+
+	opts := Options{
+		Workers: *fWorkers,
+		Median:  *fMedian,
+		StdDev:  *fStdDev,
+
+		Histogram:     *fHistogram,
+		SkipMalformed: *fSkipMalformed,
+		AllowSpecial:  *fAllowSpecial,
+		Filter:        filter,
+		Delim:         delim,
+		DecimalSep:    decimalSep,
+		TempCol:       *fTempCol,
+		SkipHeader:    *fSkipHeader,
+		Comment:       comment,
+		Stream:        *fStream,
+		Window:        *fWindow,
+		Repeat:        *fRepeat,
+		LimitBytes:    *fLimitBytes,
+		Prefault:      *fPrefault,
+		Checkpoint:    *fCheckpoint,
+		Provenance:    *fProvenance,
+		Fold:          *fFold,
+		Sample:        *fSample,
+		SampleSeed:    uint64(time.Now().UnixNano()),
+		Shared:        *fShared,
+		Validate:      *fValidate,
+	}
+
+	if setFlags["seed"] {
+		opts.SampleSeed = uint64(*fSeed)
+	}
+	if *fExplain {
+		opts.Explain = stderr
+	}
+
+	stopProgress := func() {}
+	if *fProgress {
+		opts.Progress = new(Progress)
+		stopProgress = reportProgress(logger, "Processing", "bytes", opts.Progress, time.Second)
+	}
+	// Ctrl-C cancels the run, which then prints the results of the records
+	// aggregated so far. A second one kills the process as usual.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stopSignals()
+	context.AfterFunc(ctx, stopSignals)
+	result, err := Run(ctx, paths, opts, logger)
+	stopProgress()
+	interrupted := err != nil && ctx.Err() != nil
+	if err != nil && !interrupted {
+		return err
+	}
+	if interrupted {
+		logger.Warn("Interrupted, printing partial results", "rows", result.Rows)
+	}
+	duration := result.Duration
+	if *fMetrics != "" {
+		if err := writeMetrics(*fMetrics, result); err != nil {
+			return fmt.Errorf("writing metrics: %w", err)
 		}
-		defer func() { _ = f.Close() }()
+	}
+	// Read the memory stats while the merged result is all there is on the
+	// heap, before printing allocates anything.
+	var mem *runtime.MemStats
+	if *fMemStats {
+		runtime.GC()
+		mem = new(runtime.MemStats)
+		runtime.ReadMemStats(mem)
+	}
 
+	if memProfile != nil {
 		runtime.GC() // Force GC to get up-to-date mem stats
 
-		if err := pprof.WriteHeapProfile(f); err != nil {
-			return fmt.Errorf("writing memory profile: %v", err)
+		if err := pprof.WriteHeapProfile(memProfile); err != nil {
+			return fmt.Errorf("writing memory profile: %w", err)
+		}
+	}
+
+	if *fValidate {
+		_, _ = fmt.Fprintf(stderr, "Valid: %d rows in %v\n", result.Rows, duration)
+		if *fSkipMalformed || *fAllowSpecial {
+			_, _ = fmt.Fprintf(stderr, "Skipped: %d malformed rows\n", result.Malformed)
+		}
+		if interrupted {
+			return errInterrupted
 		}
+		return nil
 	}
 
-	_, _ = fmt.Fprintln(stderr, "Billion row challenge go version")
-	_, _ = fmt.Fprintf(stderr, "Using %d parallel workers\n", *fWorkers)
+	printOpts := printOptions{
+		format: *fFormat,
+		median: *fMedian,
+		stddev: *fStdDev,
+		counts: *fCounts,
+		top:    *fTop,
+		sort:   *fSort,
+		unit:   *fUnit,
 
-	if *fGenerate {
-		return generate(*fFile)
+		minCount:    *fMinCount,
+		tempRange:   *fRange,
+		brcRounding: *fBRCRounding,
+		histogram:   *fHistogram,
+		precision:   *fPrecision,
+		provenance:  *fProvenance,
+		sample:      *fSample > 0,
+	}
+	printed := result.Stats
+	if *fStation != "" {
+		name := *fStation
+		if *fFold {
+			name = strings.ToLower(name)
+		}
+		s, ok := result.Stats[name]
+		if !ok {
+			return fmt.Errorf("station %q not found in %d stations", name, len(result.Stats))
+		}
+		printed = map[string]StationStats{name: s}
+	}
+	if err := printResults(stdout, printed, printOpts); err != nil {
+		return fmt.Errorf("printing results: %w", err)
+	}
+	// The gzip trailer has to be written before the file is closed, or the
+	// output is truncated.
+	if gzipOut != nil {
+		if err := gzipOut.Close(); err != nil {
+			return fmt.Errorf("closing gzip output: %w", err)
+		}
+	}
+	if outFile != nil {
+		if err := outFile.Close(); err != nil {
+			return fmt.Errorf("closing output file: %w", err)
+		}
 	}
+	printResultStats(stderr, duration, result.Bytes, result.Rows, result.Stats, mem, printOpts)
+	if *fExtremes {
+		printExtremes(stderr, result.Stats, printOpts)
+	}
+	if *fSkipMalformed || *fAllowSpecial {
+		_, _ = fmt.Fprintf(stderr, "Skipped: %d malformed rows\n", result.Malformed)
+	}
+	if *fTiming {
+		printWorkerTimes(stderr, result.WorkerTimes, result.Rows, duration)
+	}
+	printRuns(stderr, result.Runs)
+	if interrupted {
+		return errInterrupted
+	}
+	return nil
+}
 
-	if _, err := os.Stat(*fFile); errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf(
-			"file %s does not exist, generate data first with -generate", *fFile,
-		)
+// RunResult is what Run returns: the aggregated Result and how long producing
+// it took.
+type RunResult struct {
+	Result
+	// Duration is the wall-clock time from opening the input to having the
+	// merged stats. With Options.Repeat it covers the first run only.
+	Duration time.Duration
+	// Runs holds, with Options.Repeat, the time each run took once the files
+	// were open, starting with the first.
+	Runs []time.Duration
+}
+
+// Run aggregates the files at paths as MustRun does, without parsing flags or
+// printing anything but notes to logger, such as a file falling back to the
+// streaming path. A single path "-" reads stdin instead. If ctx is canceled,
+// Run returns the partial result of the records aggregated until then along
+// with ctx's error.
+func Run(ctx context.Context, paths []string, opts Options, logger *slog.Logger) (RunResult, error) {
+	if len(paths) == 0 {
+		return RunResult{}, errors.New("no input files given")
+	}
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	start := time.Now()
+	var result Result
+	var runs []time.Duration
+	var err error
+	switch {
+	case opts.Repeat > 1 && (opts.Checkpoint != "" || opts.Stream || opts.Window || paths[0] == "-"):
+		return RunResult{}, fmt.Errorf("-repeat needs input files that are memory-mapped whole, " +
+			"without -checkpoint, -stream or -window")
+	case opts.Checkpoint != "" && (len(paths) != 1 || paths[0] == "-" || opts.Stream):
+		return RunResult{}, fmt.Errorf("-checkpoint needs a single input file and no -stream")
+	case opts.Checkpoint != "":
+		result, err = aggregateCheckpointed(ctx, paths[0], opts, logger)
+	case len(paths) == 1 && paths[0] == "-":
+		opts.explainf("stdin: streamed in blocks of %d bytes, processed one after another", streamBlockSize)
+		var r io.Reader = stdin
+		if opts.LimitBytes > 0 {
+			r = &lineLimitReader{r: r, n: opts.LimitBytes}
+		}
+		result, err = aggregateReader(ctx, r, streamBlockSize, opts)
+	default:
+		result, runs, err = aggregateFiles(ctx, paths, opts, logger)
 	}
+	if err != nil && !canceled(err) {
+		return RunResult{}, err
+	}
+	if err := checkSums(result.Stats); err != nil {
+		return RunResult{}, err
+	}
+	duration := time.Since(start)
+	for _, run := range runs[min(1, len(runs)):] {
+		duration -= run
+	}
+	return RunResult{Result: result, Duration: duration, Runs: runs}, err
+}
+
+// canceled reports whether err comes from a canceled context, in which case
+// the aggregation functions return a partial Result along with it.
+func canceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// maxMapSize is the size of the largest file mmapFile maps, the largest length
+// a string can have: 2GB on 32-bit platforms. Larger files would have their
+// size truncated by the conversion to int, so they are refused and read
+// through the streaming path instead. It's a variable so tests can simulate
+// such files.
+var maxMapSize int64 = math.MaxInt
 
-	file, err := os.Open(*fFile)
+// mapFile memory-maps a file. It's a variable so tests can simulate
+// filesystems that don't support mmap.
+var mapFile = mmapFile
+
+// input is an opened data file, either memory-mapped or, when that isn't
+// possible, read through the streaming path.
+type input struct {
+	data   string
+	reader io.Reader // nil when data is mapped
+	window *os.File  // set instead of data when the file is mapped in windows
+	size   int64     // bytes the input yields, -1 when not known up front
+	close  func()
+	// strategy says how the input is read and why, for Options.Explain.
+	strategy string
+}
+
+// limit cuts the input short after its first n bytes and the rest of the
+// record the last of them is in, for Options.LimitBytes. Zero means no limit.
+func (in *input) limit(n int64) error {
+	if n <= 0 || (in.size >= 0 && n >= in.size) {
+		return nil
+	}
+	file, _ := in.reader.(*os.File)
+	switch {
+	case in.window != nil:
+		file = in.window
+	case in.reader == nil:
+		in.data = in.data[:segmentEnd(in.data, n-1)]
+		in.size = int64(len(in.data))
+		return nil
+	case file == nil || in.size < 0:
+		// A decompressed stream, or not a regular file: its records can only
+		// be found by reading them.
+		in.reader = &lineLimitReader{r: in.reader, n: n}
+		in.size = -1
+		return nil
+	}
+	end, err := recordEnd(file, n-1, in.size)
 	if err != nil {
-		return fmt.Errorf("opening file: %v", err)
+		return err
 	}
-	defer func() { _ = file.Close() }()
+	in.size = end
+	if in.reader != nil {
+		in.reader = io.LimitReader(file, end)
+	}
+	return nil
+}
 
-	start := time.Now()
+// openInput opens the file at path for aggregation. Gzip-compressed files
+// can't be mapped and are decompressed through the streaming path instead. The
+// streaming path is also used when stream is set and, with a note to logger, for
+// files that aren't regular files or that fail to map, as happens on some
+// network filesystems. With window, and for files larger than maxMapSize, the
+// file is left to aggregateWindows to map.
+func openInput(path string, stream, window bool, logger *slog.Logger) (*input, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf(
+			"%w: %s, generate data first with -generate", ErrFileNotFound, path,
+		)
+	}
 
-	data, cleanup, err := mmapFile(file)
+	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("memory-mapping file: %v", err)
+		return nil, fmt.Errorf("opening file: %w", err)
 	}
-	defer cleanup()
+	closeFile := func() { _ = file.Close() }
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("getting file info: %v", err)
+		closeFile()
+		return nil, fmt.Errorf("getting file info: %w", err)
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return &input{reader: file, size: -1, close: closeFile,
+			strategy: "streamed, not a regular file"}, nil
 	}
-	fileSize := fileInfo.Size()
 
-	chunks := calculateChunks(data, fileSize, *fWorkers)
-	results := make([]map[string]*StationStats, *fWorkers)
+	compressed, err := isGzip(file)
+	if err != nil {
+		closeFile()
+		return nil, fmt.Errorf("reading file header: %w", err)
+	}
+	if compressed || strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			closeFile()
+			return nil, fmt.Errorf("opening gzip stream: %w", err)
+		}
+		return &input{reader: zr, size: -1, close: func() {
+			_ = zr.Close()
+			closeFile()
+		}, strategy: "streamed, gzip-compressed"}, nil
+	}
 
-	var errg errgroup.Group
-	for i := range *fWorkers {
-		errg.Go(func() (err error) {
-			results[i], err = processChunk(data, chunks[i])
-			return err
-		})
+	if stream {
+		return &input{reader: file, size: fileInfo.Size(), close: closeFile,
+			strategy: "streamed, as requested"}, nil
 	}
-	if err := errg.Wait(); err != nil {
-		return err
+	if size := fileInfo.Size(); window || size > maxMapSize {
+		if !window {
+			logger.Info("File too large to map at once, mapping it in windows",
+				"path", path, "bytes", size, "window", mapWindow)
+		}
+		return &input{window: file, size: size, close: closeFile,
+			strategy: fmt.Sprintf("memory-mapped %d bytes at a time", mapWindow)}, nil
+	}
+	data, cleanup, err := mapFile(file)
+	if err != nil {
+		logger.Warn("Memory-mapping file failed, falling back to buffered reads", "path", path, "err", err)
+		return &input{reader: file, size: fileInfo.Size(), close: closeFile,
+			strategy: "streamed, memory-mapping failed"}, nil
+	}
+	return &input{data: data, size: fileInfo.Size(), close: func() {
+		cleanup()
+		closeFile()
+	}, strategy: "memory-mapped"}, nil
+}
+
+// aggregateFiles aggregates the files at paths into a single result, as if
+// they were one file. Records never span files, so a file without a trailing
+// newline doesn't run into the next one. The mapped files are processed
+// together by aggregateAll, the rest one after another, window by window or
+// through the streaming path, which is parallel with opts.Stream. Every file
+// is unmapped and closed once all of them are done. With opts.Repeat, the
+// mapped files are aggregated that many times and the time of every run is
+// returned along with the result of the first.
+func aggregateFiles(
+	ctx context.Context, paths []string, opts Options, logger *slog.Logger,
+) (Result, []time.Duration, error) {
+	inputs := make([]*input, 0, len(paths))
+	defer func() {
+		for _, in := range inputs {
+			in.close()
+		}
+	}()
+
+	var data []string
+	var total int64
+	for _, path := range paths {
+		in, err := openInput(path, opts.Stream, opts.Window, logger)
+		if err != nil {
+			return Result{}, nil, err
+		}
+		inputs = append(inputs, in)
+		if err := in.limit(opts.LimitBytes); err != nil {
+			return Result{}, nil, fmt.Errorf("limiting %s to %d bytes: %w", path, opts.LimitBytes, err)
+		}
+		logger.Debug("Opened input", "path", path, "strategy", in.strategy, "bytes", in.size)
+		if opts.Repeat > 1 && (in.reader != nil || in.window != nil) {
+			return Result{}, nil, fmt.Errorf("-repeat needs input files that are memory-mapped whole, %s is %s",
+				path, in.strategy)
+		}
+		switch {
+		case in.window != nil:
+			opts.explainf("%s: %s, %d bytes, every window split into chunks of its own",
+				path, in.strategy, in.size)
+		case in.reader == nil:
+			data = append(data, in.data)
+			opts.explainf("%s: %s, %d bytes, as input %d", path, in.strategy, in.size, len(data))
+		case opts.Stream:
+			opts.explainf("%s: %s, in blocks of %d bytes handed to %d workers",
+				path, in.strategy, streamBlockSize, opts.Workers)
+		default:
+			opts.explainf("%s: %s, in blocks of %d bytes processed one after another",
+				path, in.strategy, streamBlockSize)
+		}
+		if total >= 0 && in.size >= 0 {
+			total += in.size
+		} else {
+			total = -1
+		}
+	}
+	// Progress counts decompressed bytes, which have no known total.
+	opts.Progress.setTotal(max(total, 0))
+
+	if opts.Repeat <= 1 {
+		result, err := aggregateInputs(ctx, data, inputs, opts)
+		return result, nil, err
+	}
+	var result Result
+	runs := make([]time.Duration, 0, opts.Repeat)
+	for run := range opts.Repeat {
+		start := time.Now()
+		res, err := aggregateAll(ctx, data, opts)
+		if run == 0 {
+			result = res
+			if err != nil {
+				return result, runs, err
+			}
+			// The later runs are only timed, and would count every byte
+			// again.
+			opts.Progress = nil
+		} else if err != nil {
+			// The first result is complete, so a later run that is canceled
+			// just ends the timing.
+			break
+		}
+		runs = append(runs, time.Since(start))
+	}
+	return result, runs, nil
+}
+
+// aggregateInputs aggregates the opened inputs of aggregateFiles, data being
+// those that are mapped.
+func aggregateInputs(ctx context.Context, data []string, inputs []*input, opts Options) (Result, error) {
+	if opts.Provenance && len(data) < len(inputs) {
+		return aggregateInOrder(ctx, inputs, opts)
+	}
+	result, err := aggregateAll(ctx, data, opts)
+	if err != nil {
+		return result, err
+	}
+	// The inputs that aren't mapped come after the mapped ones, so that
+	// sample keys are unique across all of them.
+	inputOpts := opts
+	inputOpts.offset = opts.offset + result.Bytes
+	for _, in := range inputs {
+		var res Result
+		var err error
+		switch {
+		case in.window != nil:
+			res, _, err = aggregateWindows(ctx, in.window, in.size, inputOpts)
+		case in.reader == nil:
+			continue
+		case opts.Stream:
+			res, err = aggregateStream(ctx, in.reader, streamBlockSize, inputOpts)
+		default:
+			res, err = aggregateReader(ctx, in.reader, streamBlockSize, inputOpts)
+		}
+		if err != nil && !canceled(err) {
+			return Result{}, err
+		}
+		inputOpts.offset += res.Bytes
+		if in.window != nil {
+			// The windows ran on the same workers as the mapped files.
+			mergeSegment(&result, res, 0, opts)
+		} else {
+			mergeResults(&result, res, opts)
+		}
+		if err != nil {
+			return result, err
+		}
 	}
+	return result, nil
+}
 
-	finalStats := make(map[string]StationStats, 10000)
-	for _, workerResult := range results {
-		for station, stats := range workerResult {
-			if existing, ok := finalStats[station]; ok {
-				existing.Min = min(existing.Min, stats.Min)
-				existing.Max = max(existing.Max, stats.Max)
-				existing.Sum += stats.Sum
-				existing.Count += stats.Count
+// aggregateInOrder aggregates inputs one after another, for Provenance over
+// inputs that aren't all mapped. Lines are numbered across the inputs in
+// order, as aggregateAll numbers them across the mapped ones, so every input
+// has to be done before the lines of the next can be numbered. Sample keys
+// count bytes across the inputs in the same order.
+func aggregateInOrder(ctx context.Context, inputs []*input, opts Options) (Result, error) {
+	result := Result{Stats: make(map[string]StationStats)}
+	var lines int64
+	inputOpts := opts
+	for _, in := range inputs {
+		var res Result
+		var n int64
+		var err error
+		switch {
+		case in.window != nil:
+			res, n, err = aggregateWindows(ctx, in.window, in.size, inputOpts)
+		case in.reader == nil:
+			res, err = aggregateAll(ctx, []string{in.data}, inputOpts)
+			n = countLines(in.data)
+		default:
+			lc := &lineCounter{r: in.reader}
+			if opts.Stream {
+				res, err = aggregateStream(ctx, lc, streamBlockSize, inputOpts)
 			} else {
-				finalStats[station] = *stats
+				res, err = aggregateReader(ctx, lc, streamBlockSize, inputOpts)
 			}
+			n = lc.lines()
+		}
+		if err != nil && !canceled(err) {
+			return Result{}, err
+		}
+		mergeSegment(&result, res, lines, opts)
+		if err != nil {
+			return result, err
 		}
+		lines += n
+		inputOpts.offset += res.Bytes
 	}
+	return result, nil
+}
 
-	duration := time.Since(start)
+// countLines returns the number of lines in data, a last line without a
+// newline included.
+func countLines(data string) int64 {
+	n := int64(strings.Count(data, "\n"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		n++
+	}
+	return n
+}
 
-	printResults(stdout, finalStats)
-	printResultStats(stderr, duration, fileSize)
-	return nil
+// defaultWorkers returns the number of workers to use without -w and what it
+// was taken from. GOMAXPROCS already honours the GOMAXPROCS environment
+// variable, but before Go 1.25 it ignores cgroup CPU quotas, so in a container
+// limited to 2 CPUs on a 64 core host it would still start 64 workers, which
+// then mostly wait for their turn on the CPU.
+func defaultWorkers() (int, string) {
+	n := runtime.GOMAXPROCS(0)
+	if quota := cpuQuota(); quota > 0 && quota < n {
+		return quota, "the cgroup CPU quota"
+	}
+	return n, "GOMAXPROCS"
+}
+
+// minChunkBytes is the least input worth a worker of its own. Below it, the
+// goroutine and above all its station table cost more than the parsing they
+// would take off the other workers. It's a variable so tests can still spread
+// tiny inputs over several workers.
+var minChunkBytes int64 = 64 * 1024
+
+// capWorkers returns how many of workers are worth starting for size bytes of
+// input: one per minChunkBytes, and at least one.
+func capWorkers(workers int, size int64) int {
+	return int(min(int64(workers), max(1, size/minChunkBytes)))
+}
+
+// inputSize returns the total size of the files at paths, or -1 if it isn't
+// known up front, as for stdin and anything that isn't a regular file.
+// Compressed files count with their compressed size.
+func inputSize(paths []string) int64 {
+	var total int64
+	for _, path := range paths {
+		if path == "-" {
+			return -1
+		}
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		total += fi.Size()
+	}
+	return total
+}
+
+// utf8BOM is the byte order mark some editors put at the start of UTF-8
+// files. Left in place it would become part of the first station's name, so
+// it is skipped at the start of every input.
+const utf8BOM = "\xef\xbb\xbf"
+
+// bomLen returns the length of the byte order mark data starts with, if any.
+func bomLen(data string) int64 {
+	if strings.HasPrefix(data, utf8BOM) {
+		return int64(len(utf8BOM))
+	}
+	return 0
+}
+
+// stdinIsPipe reports whether data is being piped into the program.
+func stdinIsPipe() bool {
+	fi, err := stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+// Aggregate splits data into one chunk per worker, processes the chunks in
+// parallel and merges the per-worker results into a single map keyed by
+// station name. It does no printing, so it can be used to embed the engine in
+// other programs. Workers check ctx periodically and the first error stops
+// them all and is returned. Cancellation of ctx stops them too, but what they
+// aggregated until then is returned along with ctx's error.
+func Aggregate(ctx context.Context, data string, opts Options) (Result, error) {
+	res, err := aggregateAll(ctx, []string{data}, opts)
+	if err != nil {
+		return res, err
+	}
+	if err := checkSums(res.Stats); err != nil {
+		return Result{}, err
+	}
+	return res, nil
+}
+
+// aggregateAll is Aggregate over several inputs. Each input is split into
+// opts.Workers chunks and the workers take chunks of all inputs from a shared
+// queue, so they stay busy however the sizes of the inputs differ. Every worker
+// folds the chunks it processes into one table and the worker tables are then
+// merged by mergeTree.
+func aggregateAll(ctx context.Context, data []string, opts Options) (Result, error) {
+	type task struct {
+		data   string
+		chunk  [2]int64
+		first  bool  // the chunk starts data
+		input  int   // index of data in the inputs, for Explain
+		offset int64 // of data across the inputs, for sample keys
+	}
+	var tasks []task
+	var size int64
+	for i, d := range data {
+		chunks, err := CalculateChunks(d, int64(len(d)), opts.Workers)
+		if err != nil {
+			return Result{}, err
+		}
+		for _, c := range chunks {
+			first := c[0] == 0
+			if first {
+				c[0] = min(bomLen(d), c[1])
+			}
+			tasks = append(tasks, task{d, c, first, i, opts.offset + size})
+		}
+		size += int64(len(d))
+	}
+	if opts.Explain != nil && len(tasks) > 0 {
+		tables := "each folding its chunks into a table of its own"
+		if opts.Shared {
+			tables = "all writing into one map with striped locks"
+		}
+		opts.explainf("%d chunks taken by %d workers from a shared queue, %s", len(tasks), opts.Workers, tables)
+		for t, task := range tasks {
+			opts.explainf("chunk %d: input %d, bytes %d to %d (%d bytes)", t+1, task.input+1,
+				opts.offset+task.chunk[0], opts.offset+task.chunk[1], task.chunk[1]-task.chunk[0])
+		}
+	}
+
+	// Every chunk has to know the line it starts on to number its records,
+	// which takes a pass over the input to count the lines before it. Lines
+	// are numbered across the inputs, and an input without a trailing
+	// newline still ends its last line.
+	var firstLines []int64
+	if opts.Provenance {
+		firstLines = make([]int64, len(tasks))
+		line := int64(1)
+		for t, task := range tasks {
+			if t > 0 && task.first {
+				prev := tasks[t-1].data
+				if len(prev) > 0 && prev[len(prev)-1] != '\n' {
+					line++
+				}
+			}
+			firstLines[t] = line
+			line += int64(strings.Count(task.data[task.chunk[0]:task.chunk[1]], "\n"))
+		}
+	}
+
+	if opts.Prefault {
+		chunks := make([]string, len(tasks))
+		for t, task := range tasks {
+			chunks[t] = task.data[task.chunk[0]:task.chunk[1]]
+		}
+		stop := prefault(data, chunks)
+		defer stop()
+	}
+	if opts.Shared {
+		opts.shared = newSharedStats()
+	}
+	results := make([]chunkResult, max(opts.Workers, 0))
+	var next atomic.Int64
+	errg, ctx := errgroup.WithContext(ctx)
+	for i := range results {
+		errg.Go(func() error {
+			acc := &results[i]
+			for {
+				t := next.Add(1) - 1
+				if t >= int64(len(tasks)) {
+					return nil
+				}
+				chunkOpts := opts
+				chunkOpts.header = opts.SkipHeader && tasks[t].first
+				chunkOpts.offset = tasks[t].offset
+				if firstLines != nil {
+					chunkOpts.firstLine = firstLines[t]
+				}
+				res, err := processChunk(ctx, tasks[t].data, tasks[t].chunk, chunkOpts)
+				if err != nil && !canceled(err) {
+					return err
+				}
+				if acc.stats == nil {
+					acc.stats = res.stats
+				} else {
+					mergeTables(acc.stats, res.stats, opts)
+					releaseTable(res.stats)
+				}
+				acc.rows += res.rows
+				acc.malformed += res.malformed
+				acc.bytes += res.bytes
+				acc.duration += res.duration
+				if err != nil {
+					return err
+				}
+			}
+		})
+	}
+	// A canceled run still merges what the workers got through.
+	err := errg.Wait()
+	if err != nil && !canceled(err) {
+		return Result{}, err
+	}
+
+	tables := make([]*stationTable, 0, len(results))
+	times := make([]time.Duration, len(results))
+	var rows, malformed, consumed int64
+	for i, workerResult := range results {
+		if workerResult.stats != nil {
+			tables = append(tables, workerResult.stats)
+		}
+		rows += workerResult.rows
+		malformed += workerResult.malformed
+		consumed += workerResult.bytes
+		times[i] = workerResult.duration
+	}
+	if err != nil {
+		// Canceled: only count the bytes the workers got through, so that
+		// the I/O rate and -metrics describe the partial result.
+		size = consumed
+	}
+
+	stats := map[string]StationStats{}
+	switch {
+	case opts.shared != nil:
+		stats = opts.shared.flatten()
+	case len(tables) > 0:
+		stats = tableStats(mergeTree(tables, opts))
+	}
+	for _, t := range tables {
+		releaseTable(t)
+	}
+	return Result{
+		Stats:       stats,
+		Rows:        rows,
+		Malformed:   malformed,
+		Bytes:       size,
+		WorkerTimes: times,
+	}, err
 }
 
-func calculateChunks(data string, fileSize int64, numWorkers int) [][2]int64 {
+// CalculateChunks splits the first fileSize bytes of data into numWorkers
+// contiguous [start, end) ranges that together cover [0, fileSize). Every
+// range except the last ends just after a newline, so no record is split
+// between two chunks. When there are fewer records than workers the trailing
+// chunks are empty ranges at fileSize.
+func CalculateChunks(data string, fileSize int64, numWorkers int) ([][2]int64, error) {
+	if numWorkers < 1 {
+		return nil, fmt.Errorf("number of workers must be at least 1, got %d", numWorkers)
+	}
+	if fileSize < 0 || fileSize > int64(len(data)) {
+		return nil, fmt.Errorf(
+			"file size %d out of range for %d bytes of data", fileSize, len(data),
+		)
+	}
+
 	chunks := make([][2]int64, numWorkers)
-	chunkSize := fileSize / int64(numWorkers)
+	// A zero chunk size would make every boundary land on byte 0; one byte
+	// still hands out a record per worker until the data runs out.
+	chunkSize := max(1, fileSize/int64(numWorkers))
 
 	var currentPos int64 = 0
 	for i := range numWorkers {
 		start := currentPos
 		end := start + chunkSize
-		if end >= fileSize {
+		switch {
+		case end >= fileSize:
 			end = fileSize
-		} else {
-			newlineIndex := strings.IndexByte(data[end:], '\n')
+		case data[end-1] == '\n':
+			// The boundary already falls at the start of a record.
+		default:
+			newlineIndex := strings.IndexByte(data[end:fileSize], '\n')
 			if newlineIndex != -1 {
 				end += int64(newlineIndex) + 1
 			} else {
@@ -164,78 +1568,156 @@ func calculateChunks(data string, fileSize int64, numWorkers int) [][2]int64 {
 
 	chunks[numWorkers-1][1] = fileSize
 
-	return chunks
+	return chunks, nil
 }
 
-func readNameUntilSemicolon(input string) string {
+// SWAR ("SIMD within a register") constants used to test eight bytes at once.
+const (
+	swarOnes  = 0x0101010101010101
+	swarHighs = 0x8080808080808080
+)
+
+// readName returns the part of input before the first delim or newline, or
+// the whole input if there is neither. Stopping at newlines lets the caller
+// tell a line without a delimiter apart from a name. It compares eight bytes
+// at a time: xoring a word with delim in every byte zeroes the bytes that are
+// delimiters, and the classic haszero trick then sets the high bit of each
+// zero byte; the same is done for newlines. Only the lowest flagged byte is
+// guaranteed to be exact, which is all we need.
+func readName(input string, delim byte) string {
 	s := input
 	var offset int
+	delims := uint64(delim) * swarOnes
+	const newlines = '\n' * swarOnes
 
-	for len(s) > 7 {
-		if s[0] == ';' {
-			goto END
-		}
-		if s[1] == ';' {
-			offset++
-			goto END
+	for len(s) >= 8 {
+		w := binary.LittleEndian.Uint64([]byte(s[:8]))
+		x, y := w^delims, w^newlines
+		if found := ((x-swarOnes)&^x | (y-swarOnes)&^y) & swarHighs; found != 0 {
+			return input[:offset+bits.TrailingZeros64(found)/8]
 		}
-		if s[2] == ';' {
-			offset += 2
-			goto END
-		}
-		if s[3] == ';' {
-			offset += 3
-			goto END
-		}
-		if s[4] == ';' {
-			offset += 4
-			goto END
-		}
-		if s[5] == ';' {
-			offset += 5
-			goto END
-		}
-		if s[6] == ';' {
-			offset += 6
-			goto END
-		}
-		if s[7] == ';' {
-			offset += 7
-			goto END
-		}
-
 		s = s[8:]
 		offset += 8
 	}
 	// tail
 	for i := range len(s) {
-		if s[i] == ';' {
-			offset += i
-			goto END
+		if s[i] == delim || s[i] == '\n' {
+			return input[:offset+i]
 		}
 	}
-	// no semicolon found; return whole input
+	// no delimiter found; return whole input
 	return input
-END:
-	return input[:offset]
 }
 
-func processChunk(data string, chunk [2]int64) (map[string]*StationStats, error) {
-	stats := make(map[string]*StationStats, 10_000)
+// ctxCheckInterval is how many records processChunk parses between checks
+// for cancellation.
+const ctxCheckInterval = 1 << 16
+
+func processChunk(
+	ctx context.Context, data string, chunk [2]int64, opts Options,
+) (chunkResult, error) {
+	startTime := time.Now()
+	capacity := 10_000
+	if opts.shared != nil {
+		capacity = 0 // the table stays empty
+	}
+	stats := getStationTable(capacity)
+	delim, sep := opts.delim(), opts.decimalSep()
+	var rows, malformed int64
+	var filtered map[string]bool // station name -> matches opts.Filter
+	if opts.Filter != nil {
+		filtered = make(map[string]bool)
+	}
+	var folded map[string]string // station name -> lowercase name, for opts.Fold
+	if opts.Fold {
+		folded = make(map[string]string)
+	}
 	i := chunk[0]
 	end := chunk[1]
+	// Progress is reported at the same interval as ctx is checked rather than
+	// per row, so that workers rarely touch the shared counters.
+	reported, reportedRows := i, int64(0)
+	defer func() {
+		opts.Progress.add(end - reported)
+		opts.Progress.addRows(rows - reportedRows)
+	}()
+
+	n0 := 0
+	if opts.header {
+		// Only the chunk a file starts with holds its header, so the
+		// workers can't just skip a line of their own chunks.
+		if j := strings.IndexByte(data[i:end], '\n'); j >= 0 {
+			i += int64(j) + 1
+		} else {
+			i = end
+		}
+		n0 = 1 // the header still counts for line numbers
+	}
+	for n := n0; i < end; n++ {
+		if n%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				// Hand back the records before this one, so that an
+				// interrupted run can still print partial results.
+				return chunkResult{
+					stats:     stats,
+					rows:      rows,
+					malformed: malformed,
+					bytes:     i - chunk[0],
+					duration:  time.Since(startTime),
+				}, err
+			}
+			opts.Progress.add(i - reported)
+			opts.Progress.addRows(rows - reportedRows)
+			reported, reportedRows = i, rows
+		}
 
-	for i < end {
 		// slice of remaining data
 		remaining := data[i:end]
+		lineStart := i
+
+		// Chunks always start at the beginning of a line, so a comment can
+		// be told apart from the middle of a record in any chunk.
+		if opts.Comment != 0 && isComment(remaining, opts.Comment) {
+			if j := strings.IndexByte(remaining, '\n'); j >= 0 {
+				i += int64(j) + 1
+			} else {
+				i = end
+			}
+			continue
+		}
 
 		// extract name
-		name := readNameUntilSemicolon(remaining)
+		name := readName(remaining, delim)
 		if len(name) == len(remaining) {
-			// no semicolon found, malformed
-			break
+			// The input ends in a line without a delimiter, most likely a
+			// record cut short by an interrupted copy.
+			i = end
+			if name == "\r" {
+				continue
+			}
+			if !opts.SkipMalformed {
+				return chunkResult{}, newRecordError(
+					data, lineStart, ErrMalformedRecord, truncatedReason,
+				)
+			}
+			malformed++
+			continue
 		}
-		i += int64(len(name)) + 1 // skip name + ';'
+		if remaining[len(name)] == '\n' {
+			// A line without a delimiter. Blank lines are skipped.
+			i += int64(len(name)) + 1
+			if name == "" || name == "\r" {
+				continue
+			}
+			if !opts.SkipMalformed {
+				return chunkResult{}, newRecordError(
+					data, lineStart, ErrMalformedRecord, "missing separator",
+				)
+			}
+			malformed++
+			continue
+		}
+		i += int64(len(name)) + 1 // skip name + delimiter
 
 		// extract temperature until '\n'
 		start := i
@@ -243,100 +1725,444 @@ func processChunk(data string, chunk [2]int64) (map[string]*StationStats, error)
 			i++
 		}
 
-		temp, ok := parseTemp(data[start:i])
+		rawTemp := data[start:i]
+		if i < end && data[i] == '\n' {
+			i++
+		}
+		// Tolerate CRLF line endings and trailing blanks. Temperatures end
+		// in a digit, so the common case costs a single comparison.
+		if n := len(rawTemp); n > 0 && rawTemp[n-1]-'0' > 9 {
+			rawTemp = strings.TrimRight(rawTemp, " \t\r")
+		}
+		if opts.TempCol > 1 {
+			var ok bool
+			if rawTemp, ok = column(rawTemp, delim, opts.TempCol-1); !ok {
+				if !opts.SkipMalformed {
+					return chunkResult{}, newRecordError(data, lineStart,
+						ErrMalformedRecord, fmt.Sprintf("no column %d", opts.TempCol))
+				}
+				malformed++
+				continue
+			}
+		}
+
+		temp, ok := parseTemp(rawTemp, sep)
 		if !ok {
-			return nil, fmt.Errorf("malformed number: %q", data[start:i])
+			if !opts.SkipMalformed && !(opts.AllowSpecial && isSpecialTemp(rawTemp)) {
+				if rawTemp == "" && i == int64(len(data)) && data[i-1] != '\n' {
+					return chunkResult{}, newRecordError(
+						data, lineStart, ErrMalformedRecord, truncatedReason,
+					)
+				}
+				return chunkResult{}, tempError(data, lineStart, rawTemp, delim, sep)
+			}
+			malformed++
+			continue
+		}
+		rows++
+		if opts.Validate {
+			continue
 		}
 
-		if i < end && data[i] == '\n' {
-			i++
+		if opts.Fold {
+			name = foldName(name, folded)
+		}
+		if opts.Filter != nil {
+			match, ok := filtered[name]
+			if !ok {
+				match = opts.Filter.MatchString(name)
+				filtered[name] = match
+			}
+			if !match {
+				continue
+			}
 		}
 
-		if s, ok := stats[name]; ok {
-			s.Min = min(s.Min, temp)
-			s.Max = max(s.Max, temp)
-			s.Sum += temp
-			s.Count++
+		// Every iteration consumes one line.
+		r := reading{temp: temp, line: opts.firstLine + int64(n)}
+		if opts.Sample > 0 {
+			r.key = sampleKey(opts.SampleSeed, opts.offset+lineStart)
+		}
+		if opts.shared != nil {
+			opts.shared.add(name, r, &opts)
+			continue
+		}
+		s, ok := stats.lookup(name)
+		if ok {
+			s.add(temp, opts.StdDev)
 		} else {
-			stats[name] = &StationStats{
-				Min:   temp,
-				Max:   temp,
-				Sum:   temp,
-				Count: 1,
-			}
+			s.init(temp, &opts)
 		}
+		s.track(r, &opts)
 	}
 
-	return stats, nil
+	return chunkResult{
+		stats:     stats,
+		rows:      rows,
+		malformed: malformed,
+		bytes:     chunk[1] - chunk[0],
+		duration:  time.Since(startTime),
+	}, nil
 }
 
-func printResults(w io.Writer, stats map[string]StationStats) {
-	stationNames := make([]string, 0, len(stats))
-	for name := range stats {
-		stationNames = append(stationNames, name)
+// isComment reports whether line, after any leading spaces and tabs, starts
+// with the comment byte.
+func isComment(line string, comment byte) bool {
+	for i := range len(line) {
+		switch line[i] {
+		case ' ', '\t':
+		default:
+			return line[i] == comment
+		}
 	}
-	sort.Strings(stationNames)
+	return false
+}
 
-	_, _ = fmt.Fprint(w, "{")
-	for i, name := range stationNames {
-		s := stats[name]
-		avg := float64(s.Sum) / float64(s.Count)
-		_, _ = fmt.Fprintf(w, "%s=%.2f/%.2f/%.2f", name, s.Min, avg, s.Max)
-		if i < len(stationNames)-1 {
-			_, _ = fmt.Fprint(w, ", ")
+// column returns field k, counting from zero, of the delim-separated fields,
+// and false if there are fewer fields.
+func column(fields string, delim byte, k int) (string, bool) {
+	for ; k > 0; k-- {
+		i := strings.IndexByte(fields, delim)
+		if i < 0 {
+			return "", false
 		}
+		fields = fields[i+1:]
+	}
+	if i := strings.IndexByte(fields, delim); i >= 0 {
+		fields = fields[:i]
 	}
-	_, _ = fmt.Fprint(w, "}\n")
+	return fields, true
 }
 
-func printResultStats(w io.Writer, duration time.Duration, fileSize int64) {
+// foldName returns name in lowercase. Names that are already lowercase ASCII
+// are returned as they are, which only costs a scan; others are lowered once
+// per distinct name and then looked up in cache.
+func foldName(name string, cache map[string]string) string {
+	i := 0
+	for i < len(name) && name[i] < utf8.RuneSelf && (name[i] < 'A' || name[i] > 'Z') {
+		i++
+	}
+	if i == len(name) {
+		return name
+	}
+	lower, ok := cache[name]
+	if !ok {
+		lower = strings.ToLower(name)
+		cache[strings.Clone(name)] = lower
+	}
+	return lower
+}
+
+// Errors that callers of Run and Aggregate can check for with errors.Is. The
+// errors returned carry a message with the details around them.
+var (
+	// ErrFileNotFound is returned for an input or stations file that
+	// doesn't exist.
+	ErrFileNotFound = errors.New("file not found")
+	// ErrMalformedRecord is returned for a record that doesn't have the
+	// shape name;temperature, such as one without a separator.
+	ErrMalformedRecord = errors.New("malformed record")
+	// ErrMalformedNumber is returned for a record whose temperature doesn't
+	// parse.
+	ErrMalformedNumber = errors.New("malformed number")
+	// ErrSumOverflow is returned when a station has too many readings for
+	// its sum to be exact; see checkSums.
+	ErrSumOverflow = errors.New("sum could overflow")
+)
+
+// recordError describes a record that couldn't be parsed.
+type recordError struct {
+	Line   int64  // one-based line number of the record in the input
+	Offset int64  // of the start of the record in the input
+	Record string // the offending line, without its line ending
+	Err    error  // ErrMalformedRecord or ErrMalformedNumber
+	Reason string
+}
+
+func (e *recordError) Error() string {
+	return fmt.Sprintf("%v: %s in record %q on line %d (byte %d)",
+		e.Err, e.Reason, e.Record, e.Line, e.Offset)
+}
+
+func (e *recordError) Unwrap() error {
+	return e.Err
+}
+
+// newRecordError returns a recordError for the line of data starting at start.
+// The line is copied since data may be unmapped before the error is printed.
+// Counting the lines before it rescans data, which is fine on the way out.
+func newRecordError(data string, start int64, err error, reason string) *recordError {
+	line := data[start:]
+	if n := strings.IndexByte(line, '\n'); n >= 0 {
+		line = line[:n]
+	}
+	return &recordError{
+		Line:   int64(strings.Count(data[:start], "\n")) + 1,
+		Offset: start,
+		Record: strings.Clone(strings.TrimSuffix(line, "\r")),
+		Err:    err,
+		Reason: reason,
+	}
+}
+
+// truncatedReason is the reason given for a last record without a newline
+// that stops before its temperature, as when a file is cut off in transfer. A
+// record cut within its temperature, like "Hamburg;1" for "Hamburg;12.0",
+// can't be told from a complete one.
+const truncatedReason = "truncated record at the end of the input"
+
+// tempError returns the error for a record whose temperature, rawTemp,
+// doesn't parse. Structural problems, where the record doesn't have the
+// shape name;temperature, are told apart from a number that's just invalid.
+func tempError(data string, start int64, rawTemp string, delim, sep byte) *recordError {
+	err, reason := ErrMalformedNumber, numberReason(rawTemp, sep)
+	switch {
+	case isSpecialTemp(rawTemp):
+		reason = fmt.Sprintf("%q is not finite, see -allow-special", rawTemp)
+	case rawTemp == "":
+		err, reason = ErrMalformedRecord, "missing temperature"
+	case strings.IndexByte(rawTemp, delim) >= 0:
+		err, reason = ErrMalformedRecord, fmt.Sprintf("extra separator %q", delim)
+	}
+	return newRecordError(data, start, err, reason)
+}
+
+// numberReason says what is wrong with rawTemp, a number parseTemp rejected
+// with sep as its decimal point. Only digits, a leading sign and a single
+// decimal point are allowed, so digit grouping as in 1,000.00 is called out
+// rather than read as some other number.
+func numberReason(rawTemp string, sep byte) string {
+	digits := rawTemp
+	if len(digits) > 0 && (digits[0] == '+' || digits[0] == '-') {
+		digits = digits[1:]
+	}
+	for i := range len(digits) {
+		c := digits[i]
+		switch {
+		case c >= '0' && c <= '9':
+		case c == sep && strings.IndexByte(digits[i+1:], sep) >= 0:
+			return fmt.Sprintf("%q has more than one decimal point %q", rawTemp, sep)
+		case c != sep:
+			return fmt.Sprintf("%q has %q where only digits, a leading sign and a decimal point %q are allowed",
+				rawTemp, c, sep)
+		}
+	}
+	return fmt.Sprintf("%q needs 1 to 3 digits, then optionally a decimal point %q and 1 or 2 digits", rawTemp, sep)
+}
+
+// isSpecialTemp reports whether s spells NaN or an infinity, in any case and
+// with an optional sign, as strconv.ParseFloat would accept them. parseTemp
+// never does: they aren't temperatures and would poison min, max and mean.
+func isSpecialTemp(s string) bool {
+	if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		s = s[1:]
+	}
+	switch strings.ToLower(s) {
+	case "nan", "inf", "infinity":
+		return true
+	}
+	return false
+}
+
+// atOffset shifts the position of a recordError by the offset and number of
+// lines before the block it was found in, for inputs processed in blocks.
+func atOffset(err error, offset, lines int64) error {
+	var re *recordError
+	if errors.As(err, &re) {
+		re.Offset += offset
+		re.Line += lines
+	}
+	return err
+}
+
+// printResultStats prints the footer with the totals and speed of the run and,
+// when mem is not nil, its memory use.
+func printResultStats(
+	w io.Writer, duration time.Duration, fileSize int64, rows int64, stats map[string]StationStats,
+	mem *runtime.MemStats, opts printOptions,
+) {
 	_, _ = fmt.Fprintf(w, "\nRESULTS\n")
 	_, _ = fmt.Fprintf(w, "Total Time: %v\n", duration)
-	rowsPerSecond := float64(1_000_000_000) / duration.Seconds()
+	_, _ = fmt.Fprintf(w, "Rows: %d\n", rows)
+	_, _ = fmt.Fprintf(w, "Stations: %d\n", len(stats))
+	if mean, ok := globalMean(stats); ok {
+		_, _ = fmt.Fprintf(w, "Mean: %.2f\n", opts.temp(mean))
+	}
+	rowsPerSecond := float64(rows) / duration.Seconds()
 	gbPerSecond := float64(fileSize) / (1024 * 1024 * 1024) / duration.Seconds()
 	_, _ = fmt.Fprintf(w, "Speed: %.2f million rows/second\n", rowsPerSecond/1_000_000)
 	_, _ = fmt.Fprintf(w, "I/O Rate: %.2f GB/second\n", gbPerSecond)
+	if mem != nil {
+		// HeapAlloc right after a GC is what the result itself takes. HeapSys
+		// only grows as the heap does, so it is the closest MemStats has to
+		// the peak. Neither counts the memory-mapped input.
+		const mb = 1024 * 1024
+		_, _ = fmt.Fprintf(w, "Memory: %.1f MB heap in use, %.1f MB peak heap, %.1f MB from the OS\n",
+			float64(mem.HeapAlloc)/mb, float64(mem.HeapSys)/mb, float64(mem.Sys)/mb)
+	}
 }
 
-func generate(file string) error {
-	generator := NewBillionRowGenerator()
-
-	if err := generator.LoadStations("weather_stations.csv"); err != nil {
-		return fmt.Errorf("loading stations: %v", err)
+// globalMean returns the mean in degrees of all readings across stations, so
+// busy stations weigh more than quiet ones. ok is false if there are none.
+// The sums are added as floats since their total may not fit in an int64
+// even when each one does.
+func globalMean(stats map[string]StationStats) (mean float64, ok bool) {
+	var sum float64
+	var count int64
+	for _, s := range stats {
+		sum += float64(s.Sum)
+		count += s.Count
+	}
+	if count == 0 {
+		return 0, false
 	}
+	return sum / (float64(count) * 100), true
+}
 
-	if _, err := os.Stat(file); err == nil {
-		fmt.Printf("File %s already exists. Overwrite? (y/N): ", file)
-		var response string
-		_, _ = fmt.Scanln(&response)
-		if response != "y" && response != "Y" {
-			fmt.Println("Generation cancelled")
-			return nil
+// printExtremes prints the lowest and highest single reading across all
+// stations and the station each belongs to. Ties go to the alphabetically
+// first station.
+func printExtremes(w io.Writer, stats map[string]StationStats, opts printOptions) {
+	var coldest, hottest string
+	first := true
+	for name, s := range stats {
+		if first {
+			coldest, hottest, first = name, name, false
+			continue
+		}
+		c, h := stats[coldest], stats[hottest]
+		if s.Min < c.Min || s.Min == c.Min && name < coldest {
+			coldest = name
 		}
+		if s.Max > h.Max || s.Max == h.Max && name < hottest {
+			hottest = name
+		}
+	}
+	if first {
+		return
+	}
+	_, _ = fmt.Fprintf(w, "Coldest: %s (%s)\n", opts.exactTemp(stats[coldest].Min, 1), coldest)
+	_, _ = fmt.Fprintf(w, "Hottest: %s (%s)\n", opts.exactTemp(stats[hottest].Max, 1), hottest)
+}
+
+// printRuns prints the min, median and max time of the runs of -repeat. The
+// first run reads the input from disk unless it is cached already, while
+// the later ones find it in the page cache, so a first run much slower than
+// the median means the run is bound by I/O rather than by the CPU.
+func printRuns(w io.Writer, runs []time.Duration) {
+	if len(runs) == 0 {
+		return
+	}
+	sorted := slices.Sorted(slices.Values(runs))
+	median := (sorted[(len(sorted)-1)/2] + sorted[len(sorted)/2]) / 2
+	_, _ = fmt.Fprintf(w, "Runs: %d, first %v, min %v, median %v, max %v\n",
+		len(runs), runs[0], sorted[0], median, sorted[len(sorted)-1])
+}
+
+// printWorkerTimes prints the spread of the time workers spent processing. A
+// max far above the mean means the work was split unevenly.
+//
+// It also estimates how well the run scaled without a separate single-worker
+// run: rows over the total time the workers were busy is the speed of one
+// worker, and the parallel efficiency is the actual speed over that speed
+// times the number of workers, which comes down to the share of the wall-clock
+// time duration that the workers were busy. It drops when workers sit idle
+// waiting for others to finish or while the results are merged. A worker
+// waiting for a CPU counts as busy though, so with more workers than cores the
+// efficiency stays high while the speed doesn't improve.
+func printWorkerTimes(w io.Writer, times []time.Duration, rows int64, duration time.Duration) {
+	if len(times) == 0 {
+		return
+	}
+	lo, hi := times[0], times[0]
+	var total time.Duration
+	for _, t := range times {
+		lo, hi = min(lo, t), max(hi, t)
+		total += t
+	}
+	mean := total / time.Duration(len(times))
+	_, _ = fmt.Fprintf(w, "Worker Time: min %v, mean %v, max %v (%d workers)\n",
+		lo, mean, hi, len(times))
+	if total <= 0 || duration <= 0 {
+		return
+	}
+	perWorker := float64(rows) / total.Seconds()
+	efficiency := total.Seconds() / (duration.Seconds() * float64(len(times)))
+	_, _ = fmt.Fprintf(w, "Per-worker Speed: %.2f million rows/second\n", perWorker/1_000_000)
+	_, _ = fmt.Fprintf(w, "Parallel Efficiency: %.1f%%\n", 100*efficiency)
+}
+
+// defaultStationsFile is the station list -generate reads unless -stations
+// names another.
+const defaultStationsFile = "weather_stations.csv"
+
+func generate(generator *BillionRowGenerator, stationsFile, file string, rows int64) error {
+	if _, err := os.Stat(stationsFile); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: stations file %s, pass another with -stations", ErrFileNotFound, stationsFile)
+	}
+	if err := generator.LoadStations(stationsFile); err != nil {
+		return fmt.Errorf("loading stations: %w", err)
+	}
+
+	if !generator.append && !confirmOverwrite(file) {
+		fmt.Println("Generation cancelled")
+		return nil
 	}
 
 	totalStart := time.Now()
-	if err := generator.Generate(file); err != nil {
-		return fmt.Errorf("generating data: %v", err)
+	if err := generator.Generate(file, rows); err != nil {
+		return fmt.Errorf("generating data: %w", err)
 	}
 	totalDuration := time.Since(totalStart)
 
 	fmt.Printf("\nGENERATION COMPLETE\n")
+	fmt.Printf("Rows: %d\n", rows)
 	fmt.Printf("Total time: %v\n", totalDuration)
 	return nil
 }
 
-func parseTemp(b string) (float64, bool) {
-	if len(b) < 4 { // min "0.00"
-		return 0, false
+// generateStations writes n made-up stations to stationsFile for
+// -gen-stations. If the file exists and overwriting it isn't confirmed, it's
+// left as is, and -generate still uses it.
+func generateStations(generator *BillionRowGenerator, stationsFile string, n int) error {
+	if !confirmOverwrite(stationsFile) {
+		fmt.Println("Keeping the existing stations file")
+		return nil
+	}
+	if err := generator.GenerateStations(stationsFile, n); err != nil {
+		return fmt.Errorf("generating stations: %w", err)
 	}
+	fmt.Printf("Wrote %d weather stations to %s\n", n, stationsFile)
+	return nil
+}
+
+// confirmOverwrite asks on stdin whether to overwrite the file at path, if
+// there is one.
+func confirmOverwrite(path string) bool {
+	if _, err := os.Stat(path); err != nil {
+		return true
+	}
+	fmt.Printf("File %s already exists. Overwrite? (y/N): ", path)
+	var response string
+	_, _ = fmt.Scanln(&response)
+	return response == "y" || response == "Y"
+}
+
+// parseTemp parses a temperature with an optional leading sign and sep as
+// its decimal point into fixed-point hundredths of a degree. The common
+// shapes with two fractional digits (D.DD, DD.DD and DDD.DD) are handled by
+// unrolled fast paths; anything else goes through parseTempSlow. Only digits
+// are accepted, so NaN and infinities are rejected like any other malformed
+// value.
+func parseTemp(b string, sep byte) (int64, bool) {
 	i := 0
 	neg := false
-	if b[0] == '-' {
-		neg = true
-		i = 1
-		if len(b)-i < 4 { // need at least D.DD
-			return 0, false
+	if len(b) > 0 {
+		switch b[0] {
+		case '-':
+			neg, i = true, 1
+		case '+':
+			i = 1
 		}
 	}
 
@@ -344,7 +2170,7 @@ func parseTemp(b string) (float64, bool) {
 	// and ensure we have exactly two digits after it.
 	var intv int32
 	switch {
-	case i+3 < len(b) && b[i+1] == '.': // D.DD
+	case len(b) == i+4 && b[i+1] == sep: // D.DD
 		d0 := b[i+0] - '0'
 		d1 := b[i+2] - '0'
 		d2 := b[i+3] - '0'
@@ -357,9 +2183,9 @@ func parseTemp(b string) (float64, bool) {
 		if neg {
 			v = -v
 		}
-		return float64(v) * 0.01, true
+		return int64(v), true
 
-	case i+4 < len(b) && b[i+2] == '.': // DD.DD
+	case len(b) == i+5 && b[i+2] == sep: // DD.DD
 		d0 := b[i+0] - '0'
 		d1 := b[i+1] - '0'
 		d2 := b[i+3] - '0'
@@ -373,9 +2199,9 @@ func parseTemp(b string) (float64, bool) {
 		if neg {
 			v = -v
 		}
-		return float64(v) * 0.01, true
+		return int64(v), true
 
-	case i+5 < len(b) && b[i+3] == '.': // DDD.DD (e.g. 100.00)
+	case len(b) == i+6 && b[i+3] == sep: // DDD.DD (e.g. 100.00)
 		d0 := b[i+0] - '0'
 		d1 := b[i+1] - '0'
 		d2 := b[i+2] - '0'
@@ -390,8 +2216,44 @@ func parseTemp(b string) (float64, bool) {
 		if neg {
 			v = -v
 		}
-		return float64(v) * 0.01, true
+		return int64(v), true
 	}
 
-	return 0, false
+	return parseTempSlow(b[i:], sep, neg)
+}
+
+// parseTempSlow parses the less common temperature shapes: one to three
+// integer digits followed by an optional decimal point with one or two
+// fractional digits, e.g. 5, 12.3 or 100. b must not contain the sign.
+func parseTempSlow(b string, sep byte, neg bool) (int64, bool) {
+	intPart, frac, hasDot := strings.Cut(b, string(sep))
+	if len(intPart) < 1 || len(intPart) > 3 {
+		return 0, false
+	}
+	if hasDot && (len(frac) < 1 || len(frac) > 2) {
+		return 0, false
+	}
+
+	var v int32
+	for i := range len(intPart) {
+		d := intPart[i] - '0'
+		if d > 9 {
+			return 0, false
+		}
+		v = v*10 + int32(d)
+	}
+	v *= 100
+	scale := int32(10)
+	for i := range len(frac) {
+		d := frac[i] - '0'
+		if d > 9 {
+			return 0, false
+		}
+		v += int32(d) * scale
+		scale /= 10
+	}
+	if neg {
+		v = -v
+	}
+	return int64(v), true
 }
@@ -2,10 +2,26 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"math/big"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -33,6 +49,57 @@ stationF;1.00
 	require.Contains(t, strOut, "stationE=-999.99/-999.99/-999.99")
 	require.Contains(t, strOut, "stationF=1.00/1.00/1.00")
 	require.Contains(t, strErr, "RESULTS")
+	require.Contains(t, strErr, "Rows: 7\n")
+	require.Contains(t, strErr, "Stations: 6\n")
+}
+
+func TestRun(t *testing.T) {
+	p1 := makeFile(t, "stationA;10.00\nstationB;20.00\n")
+	p2 := makeFile(t, "stationA;30.00\nstationC;-1.50\n")
+
+	res, err := Run(context.Background(), []string{p1, p2}, Options{Workers: 2, StdDev: true}, nil)
+	require.NoError(t, err)
+	require.Positive(t, res.Duration)
+	require.Equal(t, int64(4), res.Rows)
+	require.Equal(t, int64(60), res.Bytes)
+	require.Equal(t, map[string]StationStats{
+		"stationA": {Count: 2, Min: 1000, Max: 3000, Sum: 4000, M2: 200},
+		"stationB": {Count: 1, Min: 2000, Max: 2000, Sum: 2000},
+		"stationC": {Count: 1, Min: -150, Max: -150, Sum: -150},
+	}, res.Stats)
+	a := res.Stats["stationA"]
+	require.Equal(t, 20.0, a.Mean())
+	require.Equal(t, 10.0, a.StdDev())
+}
+
+func TestRunStdin(t *testing.T) {
+	p := makeFile(t, "stationA;10.00\nstationA;30.00\n")
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	orig := stdin
+	stdin = f
+	defer func() { stdin = orig }()
+
+	res, err := Run(context.Background(), []string{"-"}, Options{Workers: 1}, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), res.Rows)
+	require.Equal(t, map[string]StationStats{
+		"stationA": {Count: 2, Min: 1000, Max: 3000, Sum: 4000},
+	}, res.Stats)
+}
+
+func TestRun_FailsWithoutInputs(t *testing.T) {
+	for _, opts := range []Options{{Workers: 1}, {Workers: 1, Repeat: 3}} {
+		_, err := Run(context.Background(), nil, opts, nil)
+		require.EqualError(t, err, "no input files given")
+	}
+}
+
+func TestRun_FailsOnMissingFile(t *testing.T) {
+	_, err := Run(context.Background(), []string{"nonexistent.txt"}, Options{Workers: 1}, nil)
+	require.ErrorIs(t, err, ErrFileNotFound)
 }
 
 func TestMustRunMalformedNumber(t *testing.T) {
@@ -41,13 +108,1887 @@ stationB;20.00
 stationA;30.00
 `)
 	err := MustRun([]string{"gobillion", "-f", p, "-w", "1"}, io.Discard, io.Discard)
-	require.ErrorContains(t, err, `malformed number: "NaN"`)
+	require.ErrorIs(t, err, ErrMalformedNumber)
+}
+
+func TestMustRunMalformedRecords(t *testing.T) {
+	allowTinyChunks(t)
+	const prefix = "stationA;10.00\nstationB;20.00\n"
+	for _, tt := range []struct {
+		name   string
+		record string
+		err    error
+		want   string
+	}{
+		{"extra separator", "sta;tion;10.0", ErrMalformedRecord, `malformed record: extra separator ';' in record "sta;tion;10.0" on line 3 (byte 30)`},
+		{"missing temperature", "stationC;", ErrMalformedRecord, `malformed record: missing temperature in record "stationC;" on line 3 (byte 30)`},
+		{"missing separator", "stationC 10.0", ErrMalformedRecord, `malformed record: missing separator in record "stationC 10.0" on line 3 (byte 30)`},
+		{"bad number", "stationC;1O.0", ErrMalformedNumber, `malformed number: "1O.0" has 'O' where only digits, a leading sign and a decimal point '.' are allowed in record "stationC;1O.0" on line 3 (byte 30)`},
+		{"digit grouping", "stationC;1,000.00", ErrMalformedNumber, `malformed number: "1,000.00" has ',' where only digits, a leading sign and a decimal point '.' are allowed in record "stationC;1,000.00" on line 3 (byte 30)`},
+		{"two decimal points", "stationC;10..0", ErrMalformedNumber, `malformed number: "10..0" has more than one decimal point '.' in record "stationC;10..0" on line 3 (byte 30)`},
+		{"three parts", "stationC;10.0.0", ErrMalformedNumber, `malformed number: "10.0.0" has more than one decimal point '.' in record "stationC;10.0.0" on line 3 (byte 30)`},
+		{"too many digits", "stationC;1000", ErrMalformedNumber, `malformed number: "1000" needs 1 to 3 digits, then optionally a decimal point '.' and 1 or 2 digits in record "stationC;1000" on line 3 (byte 30)`},
+		{"crlf", "stationC;x\r", ErrMalformedNumber, `malformed number: "x" has 'x' where only digits, a leading sign and a decimal point '.' are allowed in record "stationC;x" on line 3 (byte 30)`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := makeFile(t, prefix+tt.record+"\nstationA;30.00\n")
+			for _, mode := range [][]string{{"-w", "2"}, {"-stream"}} {
+				args := append([]string{"gobillion", "-f", p}, mode...)
+				err := MustRun(args, io.Discard, io.Discard)
+				require.ErrorIs(t, err, tt.err, "mode: %v", mode)
+				require.EqualError(t, err, tt.want, "mode: %v", mode)
+			}
+
+			// With -skip-malformed the record is counted and skipped.
+			var stdout, stderr bytes.Buffer
+			err := MustRun(
+				[]string{"gobillion", "-f", p, "-skip-malformed"}, &stdout, &stderr,
+			)
+			require.NoError(t, err)
+			require.Equal(t, "{stationA=10.00/20.00/30.00, stationB=20.00/20.00/20.00}\n", stdout.String())
+			require.Contains(t, stderr.String(), "Skipped: 1 malformed rows\n")
+		})
+	}
+
+	// The offset is relative to the whole input, even when it is streamed in
+	// blocks.
+	data := strings.Repeat(prefix, 10) + "bad\n"
+	_, err := aggregateReader(context.Background(), strings.NewReader(data), 16, Options{})
+	require.EqualError(t, err, `malformed record: missing separator in record "bad" on line 21 (byte 300)`)
+}
+
+func TestMustRunTruncatedRecord(t *testing.T) {
+	allowTinyChunks(t)
+	const prefix = "stationA;10.00\nstationB;20.00\n"
+	for _, record := range []string{"stationC", "stationC;", "stationC;\r"} {
+		p := makeFile(t, prefix+record)
+		want := `malformed record: truncated record at the end of the input in record "stationC" on line 3 (byte 30)`
+		if record != "stationC" {
+			want = `malformed record: truncated record at the end of the input in record "stationC;" on line 3 (byte 30)`
+		}
+		for _, mode := range [][]string{{"-w", "2"}, {"-stream"}, {"-window"}} {
+			args := append([]string{"gobillion", "-f", p}, mode...)
+			err := MustRun(args, io.Discard, io.Discard)
+			require.ErrorIs(t, err, ErrMalformedRecord, "record %q, mode: %v", record, mode)
+			require.EqualError(t, err, want, "record %q, mode: %v", record, mode)
+		}
+
+		var stdout, stderr bytes.Buffer
+		err := MustRun([]string{"gobillion", "-f", p, "-skip-malformed"}, &stdout, &stderr)
+		require.NoError(t, err)
+		require.Equal(t, "{stationA=10.00/10.00/10.00, stationB=20.00/20.00/20.00}\n", stdout.String())
+		require.Contains(t, stderr.String(), "Skipped: 1 malformed rows\n")
+	}
+
+	// A clean end of input, even after a stray carriage return, isn't an error.
+	for _, data := range []string{prefix, prefix + "\r", strings.TrimSuffix(prefix, "\n")} {
+		err := MustRun([]string{"gobillion", "-f", makeFile(t, data)}, io.Discard, io.Discard)
+		require.NoError(t, err, "data: %q", data)
+	}
+}
+
+func TestMustRunValidate(t *testing.T) {
+	allowTinyChunks(t)
+	var stdout, stderr bytes.Buffer
+	p := makeFile(t, "stationA;10.00\nstationB;20.00\nstationA;30.00\n")
+	err := MustRun([]string{"gobillion", "-f", p, "-validate"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Empty(t, stdout.String())
+	require.Contains(t, stderr.String(), "Valid: 3 rows in ")
+	require.NotContains(t, stderr.String(), "RESULTS")
+
+	p = makeFile(t, "stationA;10.00\nstationB;20.00\nstationA;3O.00\nstationB\n")
+	err = MustRun([]string{"gobillion", "-f", p, "-validate", "-w", "2"}, io.Discard, io.Discard)
+	require.EqualError(t, err, `malformed number: "3O.00" has 'O' where only digits, a leading sign and a decimal point '.' are allowed in record "stationA;3O.00" on line 3 (byte 30)`)
+
+	stderr.Reset()
+	err = MustRun(
+		[]string{"gobillion", "-f", p, "-validate", "-skip-malformed"}, io.Discard, &stderr,
+	)
+	require.NoError(t, err)
+	require.Contains(t, stderr.String(), "Valid: 2 rows in ")
+	require.Contains(t, stderr.String(), "Skipped: 2 malformed rows\n")
+}
+
+func TestMustRunIntegerTemps(t *testing.T) {
+	p := makeFile(t, "stationA;23\nstationA;-5\nstationB;100\nstationB;0\nstationA;1.50\n")
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "{stationA=-5.00/6.50/23.00, stationB=0.00/50.00/100.00}\n", stdout.String())
+}
+
+func TestMustRunBlankLines(t *testing.T) {
+	p := makeFile(t, "stationA;10.00\n\nstationB;20.00\r\n\r\nstationA;30.00\n\n")
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "{stationA=10.00/20.00/30.00, stationB=20.00/20.00/20.00}\n", stdout.String())
+}
+
+func TestMustRunSpecialTemps(t *testing.T) {
+	for _, tt := range []struct {
+		temp string
+		want string
+	}{
+		{"NaN", `malformed number: "NaN" is not finite, see -allow-special in record "stationC;NaN" on line 2 (byte 15)`},
+		{"inf", `malformed number: "inf" is not finite, see -allow-special in record "stationC;inf" on line 2 (byte 15)`},
+		{"+Inf", `malformed number: "+Inf" is not finite, see -allow-special in record "stationC;+Inf" on line 2 (byte 15)`},
+		{"-Infinity", `malformed number: "-Infinity" is not finite, see -allow-special in record "stationC;-Infinity" on line 2 (byte 15)`},
+		{"", `malformed record: missing temperature in record "stationC;" on line 2 (byte 15)`},
+	} {
+		p := makeFile(t, "stationA;10.00\nstationC;"+tt.temp+"\nstationA;30.00\n")
+		err := MustRun([]string{"gobillion", "-f", p}, io.Discard, io.Discard)
+		require.EqualError(t, err, tt.want)
+
+		var stdout, stderr bytes.Buffer
+		err = MustRun([]string{"gobillion", "-f", p, "-allow-special"}, &stdout, &stderr)
+		if tt.temp == "" {
+			// -allow-special only covers NaN and infinities.
+			require.EqualError(t, err, tt.want)
+			continue
+		}
+		require.NoError(t, err, tt.temp)
+		require.Equal(t, "{stationA=10.00/20.00/30.00}\n", stdout.String())
+		require.Contains(t, stderr.String(), "Skipped: 1 malformed rows\n")
+	}
+}
+
+func TestMustRunFormatJSON(t *testing.T) {
+	p := makeFile(t, `stationA;10.00
+stationB;20.00
+stationA;30.00
+`)
+
+	var stdout bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-w", "1", "-format", "json"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+
+	require.Equal(t,
+		`{"stationA":{"min":10.00,"avg":20.00,"max":30.00,"count":2},`+
+			`"stationB":{"min":20.00,"avg":20.00,"max":20.00,"count":1}}`+"\n",
+		stdout.String())
+	require.True(t, json.Valid(stdout.Bytes()))
+}
+
+func TestMustRunFormatNDJSON(t *testing.T) {
+	p := makeFile(t, "stationA;10.00\nstation \"B\";20.00\nstationA;30.00\n")
+
+	var stdout bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-format", "ndjson", "-stddev"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		`{"station":"station \"B\"","min":20.00,"avg":20.00,"max":20.00,"count":1,"stddev":0.00}`+"\n"+
+			`{"station":"stationA","min":10.00,"avg":20.00,"max":30.00,"count":2,"stddev":10.00}`+"\n",
+		stdout.String())
+	for line := range strings.Lines(stdout.String()) {
+		require.True(t, json.Valid([]byte(line)), line)
+	}
+}
+
+func TestMustRunFormatCSV(t *testing.T) {
+	p := makeFile(t, `stationA;10.00
+"quoted, station";-5.50
+stationA;30.00
+`)
+
+	var stdout bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-w", "1", "-format", "csv"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, `station,min,mean,max,count
+"""quoted, station""",-5.50,-5.50,-5.50,1
+stationA,10.00,20.00,30.00,2
+`, stdout.String())
+}
+
+func TestMustRunMedian(t *testing.T) {
+	p := makeFile(t, `stationA;10.00
+stationA;30.00
+stationA;11.00
+stationB;-5.00
+stationB;7.50
+stationB;-2.50
+stationB;0.00
+`)
+
+	var stdout bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-w", "2", "-median"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+
+	require.Equal(t,
+		"{stationA=10.00/17.00/11.00/30.00, stationB=-5.00/0.00/-1.25/7.50}\n",
+		stdout.String())
+}
+
+func TestMustRunStdDev(t *testing.T) {
+	p := makeFile(t, `stationA;2.00
+stationA;4.00
+stationA;4.00
+stationA;4.00
+stationA;5.00
+stationA;5.00
+stationA;7.00
+stationA;9.00
+stationB;1.00
+`)
+
+	for _, w := range []string{"1", "3"} {
+		var stdout bytes.Buffer
+		err := MustRun(
+			[]string{"gobillion", "-f", p, "-w", w, "-stddev"},
+			&stdout, io.Discard,
+		)
+		require.NoError(t, err)
+		require.Equal(t,
+			"{stationA=2.00/5.00/9.00/2.00, stationB=1.00/1.00/1.00/0.00}\n",
+			stdout.String(), "workers: %s", w)
+	}
+}
+
+func TestMustRunTop(t *testing.T) {
+	p := makeFile(t, `stationC;1.00
+stationA;1.00
+stationB;2.00
+stationB;4.00
+stationD;1.00
+stationC;3.00
+stationB;3.00
+`)
+	var stdout, stderr bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-w", "2", "-top", "3"},
+		&stdout, &stderr,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{stationB=2.00/3.00/4.00, stationC=1.00/2.00/3.00, stationA=1.00/1.00/1.00}\n",
+		stdout.String())
+	require.Contains(t, stderr.String(), "Rows: 7\n")
+}
+
+func TestMustRunSort(t *testing.T) {
+	p := makeFile(t, `stationC;1.00
+stationA;1.00
+stationB;2.00
+stationB;4.00
+stationD;-5.00
+stationC;3.00
+stationB;3.00
+`)
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"-sort", "mean"},
+			"{stationD=-5.00/-5.00/-5.00, stationA=1.00/1.00/1.00, stationC=1.00/2.00/3.00, stationB=2.00/3.00/4.00}\n",
+		},
+		{
+			[]string{"-sort", "mean-desc"},
+			"{stationB=2.00/3.00/4.00, stationC=1.00/2.00/3.00, stationA=1.00/1.00/1.00, stationD=-5.00/-5.00/-5.00}\n",
+		},
+		{
+			// stationA and stationD tie on count; the tie breaks alphabetically.
+			[]string{"-sort", "count"},
+			"{stationB=2.00/3.00/4.00, stationC=1.00/2.00/3.00, stationA=1.00/1.00/1.00, stationD=-5.00/-5.00/-5.00}\n",
+		},
+		{
+			[]string{"-top", "3", "-sort", "mean"},
+			"{stationA=1.00/1.00/1.00, stationC=1.00/2.00/3.00, stationB=2.00/3.00/4.00}\n",
+		},
+	} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p, "-w", "2"}, tt.args...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard))
+		require.Equal(t, tt.want, stdout.String(), "args: %v", tt.args)
+	}
+
+	err := MustRun([]string{"gobillion", "-f", p, "-sort", "max"}, io.Discard, io.Discard)
+	require.ErrorContains(t, err, `unknown sort mode "max"`)
+}
+
+func TestMustRunRange(t *testing.T) {
+	p := makeFile(t, `stationA;-5.50
+stationB;2.00
+stationA;10.25
+stationB;4.00
+stationC;0.00
+`)
+	var stdout bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-range", "-counts", "-sort", "range"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{stationA=-5.50/2.38/10.25/15.75/2, stationB=2.00/3.00/4.00/2.00/2, stationC=0.00/0.00/0.00/0.00/1}\n",
+		stdout.String())
+
+	stdout.Reset()
+	err = MustRun(
+		[]string{"gobillion", "-f", p, "-range", "-format", "csv", "-unit", "F"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+	require.Equal(t, `station,min,mean,max,count,range
+stationA,22.10,36.27,50.45,2,28.35
+stationB,35.60,37.40,39.20,2,3.60
+stationC,32.00,32.00,32.00,1,0.00
+`, stdout.String())
+}
+
+func TestMustRunHistogram(t *testing.T) {
+	p := makeFile(t, `A;-100.00
+A;-99.50
+A;0.00
+A;0.99
+A;1.00
+A;99.99
+A;100.00
+B;-0.01
+`)
+	bins := func(counts map[int]int) string {
+		s := make([]string, binCount)
+		for i := range s {
+			s[i] = strconv.Itoa(counts[i])
+		}
+		return strings.Join(s, ",")
+	}
+
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-w", "2", "-histogram"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "{A=-100.00/0.35/100.00, B=-0.01/-0.01/-0.01}\n"+
+		"A: ["+bins(map[int]int{0: 2, 100: 2, 101: 1, 199: 2})+"]\n"+
+		"B: ["+bins(map[int]int{99: 1})+"]\n",
+		stdout.String())
+
+	stdout.Reset()
+	err = MustRun(
+		[]string{"gobillion", "-f", p, "-histogram", "-format", "json"}, &stdout, io.Discard,
+	)
+	require.NoError(t, err)
+	var got map[string]struct{ Histogram []int }
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &got))
+	require.Len(t, got["B"].Histogram, binCount)
+	require.Equal(t, 1, got["B"].Histogram[99])
+
+	err = MustRun(
+		[]string{"gobillion", "-f", p, "-histogram", "-format", "csv"}, io.Discard, io.Discard,
+	)
+	require.ErrorContains(t, err, "-histogram is not supported with -format csv")
+}
+
+func TestMustRunMinCount(t *testing.T) {
+	p := makeFile(t, `stationC;1.00
+stationA;1.00
+stationB;2.00
+stationB;4.00
+stationD;-5.00
+stationC;3.00
+stationB;3.00
+`)
+	var stdout, stderr bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-min-count", "2"},
+		&stdout, &stderr,
+	)
+	require.NoError(t, err)
+	require.Equal(t, "{stationB=2.00/3.00/4.00, stationC=1.00/2.00/3.00}\n", stdout.String())
+	require.Contains(t, stderr.String(), "Rows: 7\n")
+	require.Contains(t, stderr.String(), "Stations: 4\n") // all stations, not just the printed ones
+
+	stdout.Reset()
+	err = MustRun(
+		[]string{"gobillion", "-f", p, "-min-count", "2", "-top", "1", "-sort", "mean"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+	require.Equal(t, "{stationB=2.00/3.00/4.00}\n", stdout.String())
+}
+
+func TestMustRunMultibyteNames(t *testing.T) {
+	var b strings.Builder
+	for i := range 300 {
+		for _, name := range []string{"Zürich", "東京", "Zurich", "Ærøskøbing", "Abha"} {
+			fmt.Fprintf(&b, "%s;%d.00\n", name, i%3)
+		}
+	}
+	p := makeFile(t, b.String())
+
+	want := "{Abha=0.00/1.00/2.00/300, Zurich=0.00/1.00/2.00/300, " +
+		"Zürich=0.00/1.00/2.00/300, Ærøskøbing=0.00/1.00/2.00/300, 東京=0.00/1.00/2.00/300}\n"
+	for _, w := range []string{"1", "3", "7"} {
+		var stdout bytes.Buffer
+		err := MustRun(
+			[]string{"gobillion", "-f", p, "-w", w, "-counts"}, &stdout, io.Discard,
+		)
+		require.NoError(t, err)
+		require.Equal(t, want, stdout.String(), "workers: %s", w)
+	}
+}
+
+func TestMustRunFold(t *testing.T) {
+	allowTinyChunks(t)
+	p := makeFile(t, "Paris;10.00\nparis;20.00\nPARIS;30.00\nZürich;1.00\nZÜRICH;3.00\nlyon;5.00\n")
+	for _, mode := range [][]string{{"-w", "3"}, {"-stream"}, {"-shared"}} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p, "-fold"}, mode...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard))
+		require.Equal(t,
+			"{lyon=5.00/5.00/5.00, paris=10.00/20.00/30.00, zürich=1.00/2.00/3.00}\n",
+			stdout.String(), "mode: %v", mode)
+	}
+
+	// The filter sees the folded names.
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-fold", "-filter", "^paris$"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "{paris=10.00/20.00/30.00}\n", stdout.String())
+}
+
+func TestFoldNameAllocs(t *testing.T) {
+	cache := make(map[string]string)
+	require.Equal(t, "paris", foldName("Paris", cache))
+	require.Zero(t, testing.AllocsPerRun(100, func() {
+		foldName("paris", cache)
+		foldName("Paris", cache)
+	}))
+}
+
+func TestMustRunFilter(t *testing.T) {
+	p := makeFile(t, `US_Boston;10.00
+UK_London;20.00
+US_Austin;30.00
+US_Boston;20.00
+`)
+	var stdout, stderr bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-w", "1", "-filter", "^US_"},
+		&stdout, &stderr,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{US_Austin=30.00/30.00/30.00, US_Boston=10.00/15.00/20.00}\n",
+		stdout.String())
+}
+
+func TestMustRunOutputFile(t *testing.T) {
+	p := makeFile(t, `stationA;10.00
+stationB;20.00
+`)
+	out := filepath.Join(t.TempDir(), "results.txt")
+
+	var stdout, stderr bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-o", out}, &stdout, &stderr,
+	)
+	require.NoError(t, err)
+	require.Empty(t, stdout.String())
+	require.Contains(t, stderr.String(), "RESULTS")
+
+	got, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{stationA=10.00/10.00/10.00, stationB=20.00/20.00/20.00}\n",
+		string(got))
+}
+
+func TestMustRunCRLF(t *testing.T) {
+	p := makeFile(t, "stationA;10.00\r\nstationB;-5.5\r\nstationA;30.00\r\n")
+
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-w", "2"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{stationA=10.00/20.00/30.00, stationB=-5.50/-5.50/-5.50}\n",
+		stdout.String())
+}
+
+func TestMustRunTrailingWhitespace(t *testing.T) {
+	p := makeFile(t, "stationA;10.00 \nstationB;-5.5\t\r\nstationA;30.00 \t \r\nstationB;1")
+
+	for _, mode := range [][]string{{"-w", "2"}, {"-stream"}} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p}, mode...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard), "mode: %v", mode)
+		require.Equal(t,
+			"{stationA=10.00/20.00/30.00, stationB=-5.50/-2.25/1.00}\n",
+			stdout.String(), "mode: %v", mode)
+	}
+
+	// Leading blanks and blanks inside the number are still malformed.
+	for _, record := range []string{"stationA; 10.00\n", "stationA;10 .00\n"} {
+		err := MustRun([]string{"gobillion", "-f", makeFile(t, record)}, io.Discard, io.Discard)
+		require.ErrorIs(t, err, ErrMalformedNumber, "record: %q", record)
+	}
+	err := MustRun([]string{"gobillion", "-f", makeFile(t, "stationA; \t\n")}, io.Discard, io.Discard)
+	require.ErrorIs(t, err, ErrMalformedRecord)
+	require.ErrorContains(t, err, "missing temperature")
+}
+
+func TestMustRunNoTrailingNewline(t *testing.T) {
+	p := makeFile(t, "stationA;10.00")
+
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-w", "1"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "{stationA=10.00/10.00/10.00}\n", stdout.String())
+}
+
+func TestAggregateNoTrailingNewline(t *testing.T) {
+	data := "stationA;10.00\nstationB;20.00\nstationC;-3.25"
+
+	for workers := 1; workers <= 4; workers++ {
+		res, err := Aggregate(context.Background(), data, Options{Workers: workers})
+		require.NoError(t, err)
+		require.Equal(t, int64(3), res.Rows, "workers: %d", workers)
+		require.Equal(t, int64(-325), res.Stats["stationC"].Sum, "workers: %d", workers)
+	}
+
+	res, err := aggregateReader(
+		context.Background(), strings.NewReader(data), 8, Options{},
+	)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), res.Rows)
+	require.Equal(t, int64(-325), res.Stats["stationC"].Sum)
+}
+
+func TestMustRunByteOrderMark(t *testing.T) {
+	p := makeFile(t, "\ufeffstationA;10.00\nstationB;20.00\nstationA;30.00\n")
+	want := "{stationA=10.00/20.00/30.00, stationB=20.00/20.00/20.00}\n"
+	for _, mode := range [][]string{{"-w", "2"}, {"-stream"}, {"-shared"}} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p}, mode...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard))
+		require.Equal(t, want, stdout.String(), "mode: %v", mode)
+	}
+
+	res, err := aggregateReader(context.Background(),
+		strings.NewReader("\ufeffstationA;10.00\nstationA;30.00\n"), 16, Options{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"stationA"}, slices.Collect(maps.Keys(res.Stats)))
+
+	// Only a mark at the very start of the input is skipped.
+	p = makeFile(t, "\ufeffstationA;10.00\n\ufeffstationA;30.00\n")
+	var stdout bytes.Buffer
+	require.NoError(t, MustRun([]string{"gobillion", "-f", p}, &stdout, io.Discard))
+	require.Equal(t, "{stationA=10.00/10.00/10.00, \ufeffstationA=30.00/30.00/30.00}\n", stdout.String())
+}
+
+func TestMustRunProvenance(t *testing.T) {
+	allowTinyChunks(t)
+	var b strings.Builder
+	for i := range 300 {
+		fmt.Fprintf(&b, "station%d;%d.5\n", i%7, i%50)
+		if i%40 == 0 {
+			b.WriteString("\n") // blank lines count too
+		}
+	}
+	b.WriteString("late;1.0\n")
+	p := makeFile(t, b.String())
+
+	// station0 is on line 1, late on the last line, 300 records and 8
+	// blank lines in.
+	want := "station0=0.50/25.41/49.50/L1-L303"
+	var outputs []string
+	for _, mode := range [][]string{{"-w", "4"}, {"-w", "4", "-shared"}, {"-stream"}} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p, "-provenance"}, mode...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard))
+		require.Contains(t, stdout.String(), want, "mode: %v", mode)
+		require.Contains(t, stdout.String(), "{late=1.00/1.00/1.00/L309-L309,", "mode: %v", mode)
+		outputs = append(outputs, stdout.String())
+	}
+	require.Equal(t, outputs[0], outputs[1])
+	require.Equal(t, outputs[0], outputs[2])
+
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-provenance", "-format", "csv"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Contains(t, stdout.String(), "station,min,mean,max,count,first_line,last_line\n")
+	require.Contains(t, stdout.String(), "\nlate,1.00,1.00,1.00,1,309,309\n")
+}
+
+func TestMustRunProvenanceFiles(t *testing.T) {
+	allowTinyChunks(t)
+	// Lines are numbered across the files, and the first one ends its last
+	// line without a newline.
+	first := makeFile(t, "x;1.00\ny;2.00")
+	second := makeFile(t, "z;1.00\nx;3.00\n")
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err := zw.Write([]byte("x;1.00\ny;2.00"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	gz := filepath.Join(t.TempDir(), "first.txt.gz")
+	require.NoError(t, os.WriteFile(gz, compressed.Bytes(), 0644))
+
+	want := "{x=1.00/2.00/3.00/L1-L4, y=2.00/2.00/2.00/L2-L2, z=1.00/1.00/1.00/L3-L3}\n"
+	for _, args := range [][]string{
+		{"-f", first + "," + second, "-w", "2"},
+		{"-f", first + "," + second, "-stream"},
+		{"-f", first + "," + second, "-window"},
+		{"-f", gz + "," + second, "-w", "2"}, // streamed, then mapped
+	} {
+		var stdout bytes.Buffer
+		args = append([]string{"gobillion", "-provenance"}, args...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard), "args: %v", args)
+		require.Equal(t, want, stdout.String(), "args: %v", args)
+	}
+}
+
+func TestMustRunEmptyFile(t *testing.T) {
+	p := makeFile(t, "")
+
+	var stdout, stderr bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-w", "4"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Equal(t, "{}\n", stdout.String())
+	require.Contains(t, stderr.String(), "Rows: 0\n")
+}
+
+func TestMustRunMmapFallback(t *testing.T) {
+	p := makeFile(t, `stationA;10.00
+stationB;20.00
+stationA;30.00
+`)
+	var want bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p}, &want, io.Discard)
+	require.NoError(t, err)
+
+	orig := mapFile
+	mapFile = func(*os.File) (string, func(), error) {
+		return "", nil, errors.New("mmap not supported")
+	}
+	defer func() { mapFile = orig }()
+
+	var stdout, stderr bytes.Buffer
+	err = MustRun([]string{"gobillion", "-f", p}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Equal(t, want.String(), stdout.String())
+	require.Contains(t, stderr.String(),
+		`level=WARN msg="Memory-mapping file failed, falling back to buffered reads" path=`+p+` err="mmap not supported"`)
+}
+
+func TestMustRunMmapTooLarge(t *testing.T) {
+	p := makeFile(t, "stationA;10.00\nstationB;20.00\nstationA;30.00\n")
+	var want bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p}, &want, io.Discard)
+	require.NoError(t, err)
+
+	// Pretend to be a 32-bit platform and the file to be over its limit.
+	orig := maxMapSize
+	maxMapSize = 16
+	defer func() { maxMapSize = orig }()
+
+	file, err := os.Open(p)
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+	_, _, err = mmapFile(file)
+	require.EqualError(t, err, "file of 45 bytes is larger than the 16 bytes this platform can map")
+
+	// MustRun maps the file a window at a time instead.
+	var stdout, stderr bytes.Buffer
+	err = MustRun([]string{"gobillion", "-f", p}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Equal(t, want.String(), stdout.String())
+	require.Contains(t, stderr.String(),
+		`msg="File too large to map at once, mapping it in windows" path=`+p+" bytes=45 window=1073741824\n")
+}
+
+func TestMustRunDecimalSep(t *testing.T) {
+	allowTinyChunks(t)
+	p := makeFile(t, "Paris;12,34\nLyon;-5,5\nParis;100\nLyon;7,25\n")
+
+	for _, mode := range [][]string{{"-w", "2"}, {"-stream"}} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p, "-decimal-sep", ","}, mode...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard))
+		require.Equal(t, "{Lyon=-5.50/0.88/7.25, Paris=12.34/56.17/100.00}\n", stdout.String(), "mode: %v", mode)
+	}
+
+	err := MustRun([]string{"gobillion", "-f", p}, io.Discard, io.Discard)
+	require.ErrorIs(t, err, ErrMalformedNumber)
+
+	err = MustRun([]string{"gobillion", "-f", p, "-delim", ",", "-decimal-sep", ","}, io.Discard, io.Discard)
+	require.EqualError(t, err, `-decimal-sep and -delim must differ, both are ","`)
+	err = MustRun([]string{"gobillion", "-f", p, "-decimal-sep", "-"}, io.Discard, io.Discard)
+	require.EqualError(t, err, `-decimal-sep must be a single byte other than a digit, a sign or a line break, got "-"`)
+}
+
+func TestMustRunDelim(t *testing.T) {
+	p := makeFile(t, "stationA\t10.00\nstation;B\t20.00\nstationA\t30.00\n")
+
+	var stdout bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-w", "2", "-delim", `\t`},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{station;B=20.00/20.00/20.00, stationA=10.00/20.00/30.00}\n",
+		stdout.String())
+
+	err = MustRun(
+		[]string{"gobillion", "-f", p, "-delim", ",,"}, io.Discard, io.Discard,
+	)
+	require.ErrorContains(t, err, "-delim must be a single byte")
+}
+
+func TestMustRunTempCol(t *testing.T) {
+	p := makeFile(t, "stationA,55,10.00\nstationB,60,-1.5,x\r\nstationA,40,30.00\n")
+
+	var stdout bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-delim", ",", "-temp-col", "2"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{stationA=10.00/20.00/30.00, stationB=-1.50/-1.50/-1.50}\n",
+		stdout.String())
+
+	stdout.Reset()
+	err = MustRun(
+		[]string{"gobillion", "-f", p, "-delim", ",", "-temp-col", "3"},
+		&stdout, io.Discard,
+	)
+	require.EqualError(t, err, `malformed record: no column 3 in record "stationA,55,10.00" on line 1 (byte 0)`)
+
+	var stderr bytes.Buffer
+	stdout.Reset()
+	err = MustRun(
+		[]string{"gobillion", "-f", p, "-delim", ",", "-temp-col", "3", "-skip-malformed"},
+		&stdout, &stderr,
+	)
+	require.NoError(t, err)
+	require.Equal(t, "{}\n", stdout.String())
+	require.Contains(t, stderr.String(), "Skipped: 3 malformed rows\n")
+
+	err = MustRun([]string{"gobillion", "-f", p, "-temp-col", "0"}, io.Discard, io.Discard)
+	require.EqualError(t, err, "-temp-col must be at least 1, column 0 is the station name")
+}
+
+func TestMustRunSkipHeader(t *testing.T) {
+	allowTinyChunks(t)
+	data := "station;temperature\n" + strings.Repeat("stationA;10.00\nstationB;20.00\n", 20)
+	p := makeFile(t, data)
+
+	for _, mode := range [][]string{{"-w", "1"}, {"-w", "4"}, {"-stream", "-w", "2"}} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p, "-skip-header", "-provenance"}, mode...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard), mode)
+		require.Equal(t,
+			"{stationA=10.00/10.00/10.00/L2-L40, stationB=20.00/20.00/20.00/L3-L41}\n",
+			stdout.String(), mode)
+	}
+
+	// Every file has a header of its own.
+	var stdout bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p + "," + makeFile(t, "name;temp\r\nstationC;1.00\n"), "-skip-header", "-counts"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{stationA=10.00/10.00/10.00/20, stationB=20.00/20.00/20.00/20, stationC=1.00/1.00/1.00/1}\n",
+		stdout.String())
+
+	err = MustRun([]string{"gobillion", "-f", p}, io.Discard, io.Discard)
+	require.ErrorIs(t, err, ErrMalformedNumber)
+}
+
+func TestMustRunComment(t *testing.T) {
+	allowTinyChunks(t)
+	var b strings.Builder
+	b.WriteString("# measured 2024-01-01;x\n")
+	for i := range 20 {
+		b.WriteString("stationA;10.00\n")
+		if i%3 == 0 {
+			b.WriteString("  \t# stationA;99.00\n")
+		}
+		b.WriteString("stationB;20.00\n")
+	}
+	b.WriteString("# no newline at the end")
+	p := makeFile(t, b.String())
+
+	for _, mode := range [][]string{{"-w", "1"}, {"-w", "5"}, {"-stream", "-w", "3"}} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p, "-comment", "#", "-provenance", "-counts"}, mode...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard), mode)
+		require.Equal(t,
+			"{stationA=10.00/10.00/10.00/20/L2-L47, stationB=20.00/20.00/20.00/20/L4-L48}\n",
+			stdout.String(), mode)
+	}
+
+	err := MustRun([]string{"gobillion", "-f", p}, io.Discard, io.Discard)
+	require.ErrorContains(t, err, `in record "# measured 2024-01-01;x" on line 1`)
+
+	err = MustRun([]string{"gobillion", "-f", p, "-comment", ";"}, io.Discard, io.Discard)
+	require.EqualError(t, err, `-comment must be a single byte other than a line break, a blank or -delim, got ";"`)
+}
+
+func TestMustRunStation(t *testing.T) {
+	p := makeFile(t, "Paris;10.00\nLyon;20.00\nParis;30.00\n")
+
+	var stdout, stderr bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-station", "Paris"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Equal(t, "{Paris=10.00/20.00/30.00}\n", stdout.String())
+	require.Contains(t, stderr.String(), "Stations: 2\n")
+
+	stdout.Reset()
+	err = MustRun([]string{"gobillion", "-f", p, "-station", "PARIS", "-fold", "-format", "json"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, `{"paris":{"min":10.00,"avg":20.00,"max":30.00,"count":2}}`+"\n", stdout.String())
+
+	stdout.Reset()
+	err = MustRun([]string{"gobillion", "-f", p, "-station", "Berlin"}, &stdout, io.Discard)
+	require.EqualError(t, err, `station "Berlin" not found in 2 stations`)
+	require.Empty(t, stdout.String())
+}
+
+func TestMustRunExplain(t *testing.T) {
+	allowTinyChunks(t)
+	p := makeFile(t, "a;1\nb;2\nc;3\nd;4\n")
+
+	var stdout, stderr bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-w", "2", "-explain"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Equal(t, "{a=1.00/1.00/1.00, b=2.00/2.00/2.00, c=3.00/3.00/3.00, d=4.00/4.00/4.00}\n", stdout.String())
+	plan := p + ": memory-mapped, 16 bytes, as input 1\n" +
+		"Plan: 2 chunks taken by 2 workers from a shared queue, each folding its chunks into a table of its own\n" +
+		"Plan: chunk 1: input 1, bytes 0 to 8 (8 bytes)\n" +
+		"Plan: chunk 2: input 1, bytes 8 to 16 (8 bytes)\n"
+	require.Contains(t, stderr.String(), "Plan: "+plan+"\nRESULTS\n", "the plan is printed before processing")
+
+	stderr.Reset()
+	err = MustRun([]string{"gobillion", "-f", p, "-w", "2", "-explain", "-stream"}, io.Discard, &stderr)
+	require.NoError(t, err)
+	require.Contains(t, stderr.String(),
+		"Plan: "+p+": streamed, as requested, in blocks of 4194304 bytes handed to 2 workers\n")
+	require.NotContains(t, stderr.String(), "Plan: chunk")
+}
+
+func TestMustRunRepeat(t *testing.T) {
+	allowTinyChunks(t)
+	p := makeFile(t, "stationA;10.00\nstationB;20.00\nstationA;30.00\n")
+	var want bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-w", "2"}, &want, io.Discard)
+	require.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	err = MustRun([]string{"gobillion", "-f", p, "-w", "2", "-repeat", "3"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Equal(t, want.String(), stdout.String(), "the results are printed once")
+	require.Regexp(t, `\nRuns: 3, first \S+, min \S+, median \S+, max \S+\n`, stderr.String())
+
+	got, err := Run(context.Background(), []string{p}, Options{Workers: 2, Repeat: 3}, nil)
+	require.NoError(t, err)
+	require.Len(t, got.Runs, 3)
+	require.Equal(t, int64(3), got.Rows, "only the first run counts")
+
+	err = MustRun([]string{"gobillion", "-f", p, "-repeat", "2", "-stream"}, io.Discard, io.Discard)
+	require.EqualError(t, err, "-repeat needs input files that are memory-mapped whole, without -checkpoint, -stream or -window")
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err = zw.Write([]byte("stationA;10.00\n"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	gz := filepath.Join(t.TempDir(), "data.txt.gz")
+	require.NoError(t, os.WriteFile(gz, compressed.Bytes(), 0644))
+	err = MustRun([]string{"gobillion", "-f", gz, "-repeat", "2"}, io.Discard, io.Discard)
+	require.EqualError(t, err, "-repeat needs input files that are memory-mapped whole, "+gz+" is streamed, gzip-compressed")
+}
+
+func TestRunLimitBytes(t *testing.T) {
+	data := "stationA;10.00\nstationB;20.00\nstationA;30.00\n"
+	p := makeFile(t, data)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err := zw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	gz := filepath.Join(t.TempDir(), "data.txt.gz")
+	require.NoError(t, os.WriteFile(gz, compressed.Bytes(), 0644))
+
+	for _, tt := range []struct {
+		name string
+		path string
+		opts Options
+	}{
+		{"mapped", p, Options{}},
+		{"stream", p, Options{Stream: true}},
+		{"window", p, Options{Window: true}},
+		{"checkpoint", p, Options{Checkpoint: filepath.Join(t.TempDir(), "run.checkpoint")}},
+		{"gzip", gz, Options{}},
+		{"stdin", "-", Options{}},
+	} {
+		for _, limit := range []struct {
+			bytes, wantBytes, wantRows int64
+		}{
+			{15, 15, 1}, // the limit ends a record
+			{16, 30, 2}, // the record the limit stops in is finished
+			{29, 30, 2},
+			{1000, 45, 3},
+			{0, 45, 3},
+		} {
+			if tt.path == "-" {
+				f, err := os.Open(p)
+				require.NoError(t, err)
+				orig := stdin
+				stdin = f
+				t.Cleanup(func() { stdin = orig; _ = f.Close() })
+			}
+			opts := tt.opts
+			opts.Workers, opts.LimitBytes = 2, limit.bytes
+			res, err := Run(context.Background(), []string{tt.path}, opts, nil)
+			require.NoError(t, err, "%s, limit %d", tt.name, limit.bytes)
+			require.Equal(t, limit.wantBytes, res.Bytes, "%s, limit %d", tt.name, limit.bytes)
+			require.Equal(t, limit.wantRows, res.Rows, "%s, limit %d", tt.name, limit.bytes)
+		}
+	}
+
+	var stderr bytes.Buffer
+	err = MustRun([]string{"gobillion", "-f", p, "-limit-bytes", "16"}, io.Discard, &stderr)
+	require.NoError(t, err)
+	require.Contains(t, stderr.String(), "Rows: 2\n")
+	err = MustRun([]string{"gobillion", "-f", p, "-limit-bytes", "-1"}, io.Discard, io.Discard)
+	require.EqualError(t, err, "-limit-bytes must not be negative, got -1")
+}
+
+func TestMustRunLogLevel(t *testing.T) {
+	p := makeFile(t, "stationA;10.00\nstationB;20.00\n")
+
+	var stdout, stderr bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-log-level", "error"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Equal(t, "{stationA=10.00/10.00/10.00, stationB=20.00/20.00/20.00}\n", stdout.String())
+	require.NotContains(t, stderr.String(), "level=")
+	require.Contains(t, stderr.String(), "RESULTS\n", "reports are printed at any level")
+
+	stderr.Reset()
+	err = MustRun([]string{"gobillion", "-f", p, "-log-level", "debug"}, io.Discard, &stderr)
+	require.NoError(t, err)
+	require.Contains(t, stderr.String(), `level=INFO msg="Using parallel workers"`)
+	require.Contains(t, stderr.String(), `level=DEBUG msg="Opened input" path=`+p+` strategy=memory-mapped bytes=30`+"\n")
+
+	err = MustRun([]string{"gobillion", "-f", p, "-log-level", "loud"}, io.Discard, io.Discard)
+	require.EqualError(t, err, `-log-level must be error, warn, info or debug, got "loud"`)
+}
+
+func TestMustRunGzipOut(t *testing.T) {
+	p := makeFile(t, "stationA;10.00\nstationB;20.00\n")
+	const want = "{stationA=10.00/10.00/10.00, stationB=20.00/20.00/20.00}\n"
+	gunzip := func(data []byte) string {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		out, err := io.ReadAll(zr)
+		require.NoError(t, err, "the gzip stream is complete")
+		return string(out)
+	}
+
+	out := filepath.Join(t.TempDir(), "results.txt.gz")
+	var stdout, stderr bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-o", out, "-gzip-out"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Empty(t, stdout.String())
+	require.Contains(t, stderr.String(), "RESULTS\n")
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, want, gunzip(data))
+
+	stdout.Reset()
+	err = MustRun([]string{"gobillion", "-f", p, "-gzip-out"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, want, gunzip(stdout.Bytes()))
+}
+
+func TestMustRunCounts(t *testing.T) {
+	p := makeFile(t, strings.Repeat("stationA;10.00\nstationB;20.00\nstationA;30.00\n", 50))
+
+	for _, w := range []string{"1", "4", "7"} {
+		var stdout bytes.Buffer
+		err := MustRun(
+			[]string{"gobillion", "-f", p, "-w", w, "-counts"},
+			&stdout, io.Discard,
+		)
+		require.NoError(t, err)
+		require.Equal(t,
+			"{stationA=10.00/20.00/30.00/100, stationB=20.00/20.00/20.00/50}\n",
+			stdout.String(), "workers: %s", w)
+	}
+}
+
+func TestMustRunUnitFahrenheit(t *testing.T) {
+	p := makeFile(t, "stationA;-40.00\nstationA;100.00\nstationB;37.00\n")
+
+	var stdout bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-unit", "F", "-stddev"},
+		&stdout, io.Discard,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{stationA=-40.00/86.00/212.00/126.00, stationB=98.60/98.60/98.60/0.00}\n",
+		stdout.String())
+
+	err = MustRun([]string{"gobillion", "-f", p, "-unit", "K"}, io.Discard, io.Discard)
+	require.ErrorContains(t, err, `unknown unit "K"`)
+}
+
+func TestMustRunBRCRounding(t *testing.T) {
+	p := makeFile(t, `A;0.10
+A;0.20
+B;-0.20
+B;-0.30
+C;12.35
+D;-0.05
+`)
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{A=0.10/0.15/0.20, B=-0.30/-0.25/-0.20, C=12.35/12.35/12.35, D=-0.05/-0.05/-0.05}\n",
+		stdout.String())
+
+	// Halves round up, towards positive infinity, including negative ones.
+	stdout.Reset()
+	err = MustRun([]string{"gobillion", "-f", p, "-brc-rounding"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{A=0.1/0.2/0.2, B=-0.3/-0.2/-0.2, C=12.4/12.4/12.4, D=0.0/0.0/0.0}\n",
+		stdout.String())
+}
+
+func TestFormatTemp(t *testing.T) {
+	brc := printOptions{unit: unitCelsius, brcRounding: true, precision: 1}
+	for _, tt := range []struct {
+		num, den int64
+		want     string
+	}{
+		{15, 1, "0.2"},
+		{-15, 1, "-0.1"},
+		{-25, 1, "-0.2"},
+		{45, 3, "0.2"}, // 0.15
+		{44, 3, "0.1"}, // 0.1466...
+		{-9999, 1, "-100.0"},
+		{9995, 1, "100.0"},
+	} {
+		require.Equal(t, tt.want, brc.exactTemp(tt.num, tt.den), "%d/%d", tt.num, tt.den)
+	}
+
+	fahrenheit := printOptions{unit: unitFahrenheit, brcRounding: true, precision: 1}
+	require.Equal(t, "32.3", fahrenheit.formatTemp(0.15)) // 32.27
+	require.Equal(t, "0.15", printOptions{precision: 2}.exactTemp(45, 3))
+
+	// Other precisions round the last printed digit the same way.
+	for _, tt := range []struct {
+		precision int
+		num, den  int64
+		want      string
+	}{
+		{0, 150, 1, "2"},
+		{0, -150, 1, "-1"},
+		{0, -50, 1, "0"},
+		{2, 1, 2, "0.01"},
+		{4, 45, 3, "0.1500"},
+		{4, 1, 3, "0.0033"},
+		{4, -2, 3, "-0.0067"},
+		{6, -99999, 7, "-142.855714"},
+	} {
+		brc.precision = tt.precision
+		require.Equal(t, tt.want, brc.exactTemp(tt.num, tt.den), "%d/%d at %d", tt.num, tt.den, tt.precision)
+	}
+}
+
+func TestMustRunPrecision(t *testing.T) {
+	p := makeFile(t, "A;10.00\nA;20.00\nA;20.00\n")
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "{A=10.00/16.67/20.00/4.71}\n"},
+		{[]string{"-precision", "4"}, "{A=10.0000/16.6667/20.0000/4.7140}\n"},
+		{[]string{"-precision", "1"}, "{A=10.0/16.7/20.0/4.7}\n"},
+		{[]string{"-precision", "0"}, "{A=10/17/20/5}\n"},
+		{[]string{"-brc-rounding"}, "{A=10.0/16.7/20.0/4.7}\n"},
+		{[]string{"-brc-rounding", "-precision", "3"}, "{A=10.000/16.667/20.000/4.714}\n"},
+	} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p, "-stddev"}, tt.args...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard))
+		require.Equal(t, tt.want, stdout.String(), "%v", tt.args)
+	}
+
+	for _, precision := range []string{"-1", "7"} {
+		err := MustRun([]string{"gobillion", "-f", p, "-precision", precision}, io.Discard, io.Discard)
+		require.EqualError(t, err, "-precision must be between 0 and 6, got "+precision)
+	}
+}
+
+func TestMustRunSameOutputForAnyWorkerCount(t *testing.T) {
+	allowTinyChunks(t)
+	rng := rand.New(rand.NewPCG(3, 4))
+	var b strings.Builder
+	for range 20_000 {
+		fmt.Fprintf(&b, "station%d;%.2f\n", rng.IntN(50), -99.99+rng.Float64()*199.98)
+	}
+	p := makeFile(t, b.String())
+
+	var outputs []string
+	for _, w := range []string{"1", "3", "8"} {
+		var stdout bytes.Buffer
+		err := MustRun(
+			[]string{"gobillion", "-f", p, "-w", w, "-median", "-counts"},
+			&stdout, io.Discard,
+		)
+		require.NoError(t, err)
+		outputs = append(outputs, stdout.String())
+	}
+	require.Equal(t, outputs[0], outputs[1])
+	require.Equal(t, outputs[0], outputs[2])
+}
+
+func TestMustRunProfMem(t *testing.T) {
+	p := makeFile(t, "stationA;1.00\nstationB;2.00\n")
+	for _, extra := range [][]string{nil, {"-validate"}} {
+		profile := filepath.Join(t.TempDir(), "heap.prof")
+		args := append([]string{"gobillion", "-f", p, "-profmem", profile}, extra...)
+		require.NoError(t, MustRun(args, io.Discard, io.Discard))
+
+		fi, err := os.Stat(profile)
+		require.NoError(t, err)
+		require.NotZero(t, fi.Size(), "args: %v", args)
+	}
+}
+
+func TestMustRunTiming(t *testing.T) {
+	allowTinyChunks(t)
+	p := makeFile(t, strings.Repeat("stationA;10.00\nstationB;20.00\n", 100))
+
+	var stderr bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-w", "3", "-timing"}, io.Discard, &stderr,
+	)
+	require.NoError(t, err)
+	require.Regexp(t, `Worker Time: min \S+, mean \S+, max \S+ \(3 workers\)\n`, stderr.String())
+	require.Regexp(t, `\nPer-worker Speed: \d+\.\d\d million rows/second\nParallel Efficiency: \d+\.\d%\n`, stderr.String())
+
+	stderr.Reset()
+	err = MustRun([]string{"gobillion", "-f", p, "-w", "3"}, io.Discard, &stderr)
+	require.NoError(t, err)
+	require.NotContains(t, stderr.String(), "Worker Time")
+	require.NotContains(t, stderr.String(), "Parallel Efficiency")
+
+	var buf bytes.Buffer
+	times := []time.Duration{2 * time.Second, 4 * time.Second}
+	printWorkerTimes(&buf, times, 3_000_000, 4*time.Second)
+	require.Equal(t, "Worker Time: min 2s, mean 3s, max 4s (2 workers)\n"+
+		"Per-worker Speed: 0.50 million rows/second\n"+
+		"Parallel Efficiency: 75.0%\n", buf.String())
+}
+
+func TestMustRunMemStats(t *testing.T) {
+	p := makeFile(t, "stationA;10.00\nstationB;20.00\n")
+
+	var stderr bytes.Buffer
+	require.NoError(t, MustRun([]string{"gobillion", "-f", p, "-memstats"}, io.Discard, &stderr))
+	require.Regexp(t, `I/O Rate: .*\nMemory: \d+\.\d MB heap in use, \d+\.\d MB peak heap, \d+\.\d MB from the OS\n`, stderr.String())
+
+	stderr.Reset()
+	require.NoError(t, MustRun([]string{"gobillion", "-f", p}, io.Discard, &stderr))
+	require.NotContains(t, stderr.String(), "Memory:")
+}
+
+func TestMustRunCapsWorkersForTinyInput(t *testing.T) {
+	p := makeFile(t, strings.Repeat("stationA;10.00\nstationB;20.00\n", 3)+"stC;-1.25\n")
+
+	var stdout, stderr bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-w", "64", "-timing"}, &stdout, &stderr)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{stC=-1.25/-1.25/-1.25, stationA=10.00/10.00/10.00, stationB=20.00/20.00/20.00}\n",
+		stdout.String())
+	require.Contains(t, stderr.String(), `msg="Reducing workers for a small input" from=64 to=1 bytes=100`+"\n")
+	require.Contains(t, stderr.String(), `msg="Using parallel workers" workers=1 source=-w`+"\n")
+	require.Contains(t, stderr.String(), "(1 workers)\n")
+
+	stderr.Reset()
+	require.NoError(t, MustRun([]string{"gobillion", "-f", p}, io.Discard, &stderr))
+	require.Regexp(t, `msg="Using parallel workers" workers=1 source=(GOMAXPROCS|"the cgroup CPU quota")\n`, stderr.String())
+
+	require.Equal(t, 4, capWorkers(4, 10*minChunkBytes))
+	require.Equal(t, 2, capWorkers(4, 2*minChunkBytes+1))
+}
+
+func TestGlobalMean(t *testing.T) {
+	// Weighted by count: three readings of 10 and one of 30 average to 15,
+	// not to the 20 the station means would.
+	mean, ok := globalMean(map[string]StationStats{
+		"A": {Count: 3, Sum: 3000},
+		"B": {Count: 1, Sum: 3000},
+	})
+	require.True(t, ok)
+	require.InDelta(t, 15.0, mean, 1e-9)
+
+	// The total of sums that each fit in an int64 may not.
+	mean, ok = globalMean(map[string]StationStats{
+		"A": {Count: maxSafeCount, Sum: maxSafeCount * maxTemp},
+		"B": {Count: maxSafeCount, Sum: maxSafeCount * maxTemp},
+	})
+	require.True(t, ok)
+	require.InDelta(t, degrees(maxTemp), mean, 1e-9)
+
+	_, ok = globalMean(map[string]StationStats{})
+	require.False(t, ok)
+}
+
+func TestMustRunExtremes(t *testing.T) {
+	p := makeFile(t, "B;-12.50\nA;30.00\nC;-12.50\nB;45.25\nA;1.00\n")
+
+	var stderr bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-extremes", "-unit", "F"}, io.Discard, &stderr)
+	require.NoError(t, err)
+	require.Contains(t, stderr.String(), "Stations: 3\nMean: 50.45\nSpeed: ")
+	require.Contains(t, stderr.String(), "Coldest: 9.50 (B)\nHottest: 113.45 (B)\n")
+
+	stderr.Reset()
+	err = MustRun([]string{"gobillion", "-f", p}, io.Discard, &stderr)
+	require.NoError(t, err)
+	require.NotContains(t, stderr.String(), "Coldest")
+}
+
+func TestMustRunVersion(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "v1.2.3", "abc1234"
+
+	var stdout, stderr bytes.Buffer
+	// -f points nowhere: -version must return before touching the input.
+	err := MustRun(
+		[]string{"gobillion", "-version", "-f", "does-not-exist.txt"},
+		&stdout, &stderr,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		"billion-rows v1.2.3\ncommit: abc1234\ngo: "+runtime.Version()+"\n",
+		stdout.String())
+	require.Empty(t, stderr.String())
+}
+
+func TestMustRunMergesWorkers(t *testing.T) {
+	// Enough rows for two workers, each of which only sees one of the
+	// readings.
+	const n = 5000
+	p := makeFile(t, strings.Repeat("stationA;10.00\n", n)+strings.Repeat("stationA;30.00\n", n))
+
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-w", "2"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "{stationA=10.00/20.00/30.00}\n", stdout.String())
+}
+
+func TestMustRun_FailsOnUnknownFormat(t *testing.T) {
+	err := MustRun(
+		[]string{"cmd", "-f", "nonexistent.txt", "-format", "xml"},
+		io.Discard, io.Discard,
+	)
+	require.ErrorContains(t, err, `unknown output format "xml"`)
+}
+
+func TestMustRunSkipMalformed(t *testing.T) {
+	p := makeFile(t, `stationA;NaN
+stationB;20.00
+stationA;1.2.3
+stationA;30.00
+`)
+	var stdout, stderr bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", p, "-w", "1", "-skip-malformed"},
+		&stdout, &stderr,
+	)
+	require.NoError(t, err)
+	require.Equal(t,
+		"{stationA=30.00/30.00/30.00, stationB=20.00/20.00/20.00}\n",
+		stdout.String())
+	require.Contains(t, stderr.String(), "Rows: 2\n")
+	require.Contains(t, stderr.String(), "Skipped: 2 malformed rows\n")
 }
 
 func TestMustRun_FailsOnMissingFile(t *testing.T) {
 	var stdout, stderr bytes.Buffer
 	err := MustRun([]string{"cmd", "-f", "nonexistent.txt"}, &stdout, &stderr)
-	require.ErrorContains(t, err, `file nonexistent.txt does not exist`)
+	require.ErrorIs(t, err, ErrFileNotFound)
+	require.EqualError(t, err, "file not found: nonexistent.txt, generate data first with -generate")
+}
+
+func TestAggregate(t *testing.T) {
+	data := `stationA;10.00
+stationB;20.00
+stationA;30.00
+stationC;-1.50
+`
+	res, err := Aggregate(context.Background(), data, Options{Workers: 2})
+	require.NoError(t, err)
+	require.Len(t, res.WorkerTimes, 2)
+	res.WorkerTimes = nil
+
+	require.Equal(t, Result{
+		Stats: map[string]StationStats{
+			"stationA": {Count: 2, Min: 1000, Max: 3000, Sum: 4000},
+			"stationB": {Count: 1, Min: 2000, Max: 2000, Sum: 2000},
+			"stationC": {Count: 1, Min: -150, Max: -150, Sum: -150},
+		},
+		Rows:  4,
+		Bytes: int64(len(data)),
+	}, res)
+}
+
+func TestMustRunStdin(t *testing.T) {
+	p := makeFile(t, `stationA;10.00
+stationB;20.00
+stationA;30.00
+`)
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	orig := stdin
+	stdin = f
+	defer func() { stdin = orig }()
+
+	var stdout bytes.Buffer
+	err = MustRun([]string{"gobillion", "-f", "-"}, &stdout, io.Discard)
+	require.NoError(t, err)
+
+	require.Equal(t,
+		"{stationA=10.00/20.00/30.00, stationB=20.00/20.00/20.00}\n",
+		stdout.String())
+}
+
+func TestAggregateReaderMatchesAggregate(t *testing.T) {
+	data := `stationA;10.00
+stationB;20.00
+a much longer station name than the block size;-7.25
+stationA;30.00
+stationC;-1.50`
+	want, err := Aggregate(context.Background(), data, Options{Workers: 3, Median: true})
+	require.NoError(t, err)
+
+	got, err := aggregateReader(
+		context.Background(), strings.NewReader(data), 16, Options{Median: true},
+	)
+	require.NoError(t, err)
+	want.WorkerTimes, got.WorkerTimes = nil, nil
+	require.Equal(t, want, got)
+}
+
+func TestAggregateStreamMatchesAggregate(t *testing.T) {
+	data := benchmarkData()
+	data = data[:strings.IndexByte(data[200_000:], '\n')+200_001]
+	opts := Options{Workers: 4, Median: true, StdDev: true}
+	want, err := Aggregate(context.Background(), data, opts)
+	require.NoError(t, err)
+
+	got, err := aggregateStream(context.Background(), strings.NewReader(data), 4096, opts)
+	require.NoError(t, err)
+	require.Equal(t, want.Rows, got.Rows)
+	require.Equal(t, want.Bytes, got.Bytes)
+	require.Len(t, got.Stats, len(want.Stats))
+	for name, w := range want.Stats {
+		g := got.Stats[name]
+		require.InDelta(t, w.M2, g.M2, 1e-6, name)
+		w.M2, g.M2 = 0, 0
+		require.Equal(t, w, g, name)
+	}
+}
+
+func TestMustRunStreamMatchesMmap(t *testing.T) {
+	p := makeFile(t, benchmarkData())
+	args := []string{"gobillion", "-f", p, "-w", "3", "-median", "-stddev", "-counts"}
+
+	var mmapped, streamed bytes.Buffer
+	require.NoError(t, MustRun(args, &mmapped, io.Discard))
+	require.NoError(t, MustRun(append(args, "-stream"), &streamed, io.Discard))
+	require.Equal(t, mmapped.String(), streamed.String())
+}
+
+func TestMustRunGzip(t *testing.T) {
+	contents := `stationA;10.00
+stationB;20.00
+stationA;30.00
+`
+	var plain bytes.Buffer
+	err := MustRun(
+		[]string{"gobillion", "-f", makeFile(t, contents)}, &plain, io.Discard,
+	)
+	require.NoError(t, err)
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err = zw.Write([]byte(contents))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	p := filepath.Join(t.TempDir(), "test.txt.gz")
+	require.NoError(t, os.WriteFile(p, compressed.Bytes(), 0644))
+
+	var stdout bytes.Buffer
+	err = MustRun([]string{"gobillion", "-f", p}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, plain.String(), stdout.String())
+}
+
+func TestMustRunMultipleFiles(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	var parts [3]strings.Builder
+	for i := range 3000 {
+		fmt.Fprintf(&parts[i%3], "station%d;%.2f\n", rng.IntN(20), -99.99+rng.Float64()*199.98)
+	}
+	// The middle file has no trailing newline: its last record must not run
+	// into the first record of the next file.
+	middle := strings.TrimSuffix(parts[1].String(), "\n")
+	all := parts[0].String() + middle + "\n" + parts[2].String()
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err := zw.Write([]byte(parts[2].String()))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	gz := filepath.Join(t.TempDir(), "part3.txt.gz")
+	require.NoError(t, os.WriteFile(gz, compressed.Bytes(), 0644))
+
+	args := []string{"-w", "4", "-median", "-stddev", "-counts"}
+	var want bytes.Buffer
+	err = MustRun(append([]string{"gobillion", "-f", makeFile(t, all)}, args...), &want, io.Discard)
+	require.NoError(t, err)
+
+	files := strings.Join([]string{makeFile(t, parts[0].String()), makeFile(t, middle), gz}, ",")
+	var got, stderr bytes.Buffer
+	err = MustRun(append([]string{"gobillion", "-f", files}, args...), &got, &stderr)
+	require.NoError(t, err)
+	require.Equal(t, want.String(), got.String())
+	require.Contains(t, stderr.String(), "Rows: 3000\n")
+
+	err = MustRun([]string{"gobillion", "-f", files + ",missing.txt"}, io.Discard, io.Discard)
+	require.ErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestCalculateChunks(t *testing.T) {
+	var b strings.Builder
+	for i := range 200 {
+		fmt.Fprintf(&b, "station%d;%d.5\n", i%13, i%40)
+	}
+	long := b.String()
+
+	for _, tt := range []struct {
+		name    string
+		data    string
+		workers int
+	}{
+		{"one worker", long, 1},
+		{"many workers", long, 7},
+		{"no trailing newline", strings.TrimSuffix(long, "\n"), 5},
+		{"fewer bytes than workers", "a\nb", 8},
+		{"single record", "a;1.0\n", 4},
+		{"empty", "", 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			size := int64(len(tt.data))
+			chunks, err := CalculateChunks(tt.data, size, tt.workers)
+			require.NoError(t, err)
+			require.Len(t, chunks, tt.workers)
+
+			require.Equal(t, int64(0), chunks[0][0])
+			require.Equal(t, size, chunks[len(chunks)-1][1])
+			for i, c := range chunks {
+				require.LessOrEqual(t, c[0], c[1], "chunk %d", i)
+				if i+1 < len(chunks) {
+					require.Equal(t, c[1], chunks[i+1][0], "chunk %d", i)
+				}
+				// A chunk that isn't empty and doesn't end the data must end
+				// on a newline, otherwise a record was split.
+				if c[0] < c[1] && c[1] < size {
+					require.Equal(t, byte('\n'), tt.data[c[1]-1], "chunk %d", i)
+				}
+			}
+		})
+	}
+
+	_, err := CalculateChunks("a\n", 2, 0)
+	require.ErrorContains(t, err, "at least 1")
+	_, err = CalculateChunks("a\n", 3, 2)
+	require.ErrorContains(t, err, "out of range")
+}
+
+func TestAggregateChunkBoundaries(t *testing.T) {
+	var b strings.Builder
+	lines := 0
+	for i := 0; b.Len() < 4096; i++ {
+		fmt.Fprintf(&b, "station%s;%d.%02d\n", strings.Repeat("x", i%13), i%50, i%100)
+		lines++
+	}
+	// Pad a last record so the size is divisible by every worker count up to
+	// 10 and chunk boundaries fall both on and inside records.
+	const multiple = 2520
+	padding := multiple - b.Len()%multiple
+	if padding < len("p;1.00\n") {
+		padding += multiple
+	}
+	fmt.Fprintf(&b, "p%s;1.00\n", strings.Repeat("x", padding-len("p;1.00\n")))
+	lines++
+	data := b.String()
+
+	for workers := 1; workers <= 16; workers++ {
+		chunks, err := CalculateChunks(data, int64(len(data)), workers)
+		require.NoError(t, err)
+		for i, c := range chunks {
+			if c[0] > 0 && c[0] < int64(len(data)) {
+				require.Equal(t, byte('\n'), data[c[0]-1], "chunk %d of %d", i, workers)
+			}
+		}
+
+		res, err := Aggregate(context.Background(), data, Options{Workers: workers})
+		require.NoError(t, err)
+
+		var rows int64
+		for _, s := range res.Stats {
+			rows += s.Count
+		}
+		require.Equal(t, int64(lines), rows, "workers: %d", workers)
+		require.Equal(t, int64(lines), res.Rows, "workers: %d", workers)
+	}
+}
+
+func TestParseTemp(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{in: "1.23", want: 123, ok: true},
+		{in: "-12.34", want: -1234, ok: true},
+		{in: "100.00", want: 10000, ok: true},
+		{in: "-999.99", want: -99999, ok: true},
+		{in: "-100.00", want: -10000, ok: true},
+		{in: "-100.0", want: -10000, ok: true},
+		{in: "-100", want: -10000, ok: true},
+		{in: "-10.00", want: -1000, ok: true},
+		{in: "-0.01", want: -1, ok: true},
+		{in: "5", want: 500, ok: true},
+		{in: "5.1", want: 510, ok: true},
+		{in: "-0.5", want: -50, ok: true},
+		{in: "100", want: 10000, ok: true},
+		{in: "12.3", want: 1230, ok: true},
+		{in: "-7", want: -700, ok: true},
+		{in: "+0.00", want: 0, ok: true},
+		{in: "+99.99", want: 9999, ok: true},
+		{in: "+1.23", want: 123, ok: true},
+		{in: "+100.00", want: 10000, ok: true},
+		{in: "+5", want: 500, ok: true},
+		{in: "23", want: 2300, ok: true},
+		{in: "-5", want: -500, ok: true},
+		{in: "0", want: 0, ok: true},
+		{in: "-0", want: 0, ok: true},
+		{in: "", ok: false},
+		{in: "-", ok: false},
+		{in: "+", ok: false},
+		{in: "+.00", ok: false},
+		{in: "+-1.00", ok: false},
+		{in: "-+1.00", ok: false},
+		{in: "++1.00", ok: false},
+		{in: "5.", ok: false},
+		{in: ".5", ok: false},
+		{in: "1.234", ok: false},
+		{in: "1000", ok: false},
+		{in: "-1000", ok: false},
+		{in: "-1000.00", ok: false},
+		{in: "-100.000", ok: false},
+		{in: "-100.", ok: false},
+		{in: "--100.00", ok: false},
+		{in: "1a.00", ok: false},
+		{in: "NaN", ok: false},
+		{in: "1,000.00", ok: false},
+		{in: "10..0", ok: false},
+		{in: "10.0.0", ok: false},
+	} {
+		got, ok := parseTemp(tc.in, '.')
+		require.Equal(t, tc.ok, ok, "input: %q", tc.in)
+		require.Equal(t, tc.want, got, "input: %q", tc.in)
+
+		// With a comma as the decimal point, the same values parse when
+		// written with a comma, and those with a point no longer do.
+		comma := strings.ReplaceAll(tc.in, ".", ",")
+		got, ok = parseTemp(comma, ',')
+		require.Equal(t, tc.ok, ok, "input: %q", comma)
+		require.Equal(t, tc.want, got, "input: %q", comma)
+		if strings.Contains(tc.in, ".") {
+			_, ok = parseTemp(tc.in, ',')
+			require.False(t, ok, "input: %q", tc.in)
+		}
+	}
+}
+
+// TestParseTempMatchesParseFloat checks every value in the supported range,
+// -999.99 to 999.99, in each shape it can be written in.
+func TestParseTempMatchesParseFloat(t *testing.T) {
+	check := func(s string, want int64) {
+		got, ok := parseTemp(s, '.')
+		if !ok || got != want {
+			t.Fatalf("parseTemp(%q) = %d, %v, want %d", s, got, ok, want)
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		require.NoError(t, err)
+		require.Equal(t, float64(want), math.Round(f*100), s)
+	}
+	for v := int64(-99_999); v <= 99_999; v++ {
+		s := strconv.FormatFloat(float64(v)/100, 'f', 2, 64)
+		check(s, v)
+		if v >= 0 {
+			check("+"+s, v)
+		}
+		if v%10 == 0 {
+			check(strconv.FormatFloat(float64(v)/100, 'f', 1, 64), v)
+		}
+		if v%100 == 0 {
+			check(strconv.FormatInt(v/100, 10), v)
+		}
+	}
+}
+
+// TestAggregateMeanMatchesExact checks averages against exact rational
+// arithmetic on a dataset where summing float64 values drifts visibly.
+func TestAggregateMeanMatchesExact(t *testing.T) {
+	var b strings.Builder
+	sum := new(big.Rat)
+	const rows = 200_000
+	for i := range rows {
+		v := []string{"0.01", "0.07", "0.10", "999.99", "-999.97", "0.33"}[i%6]
+		fmt.Fprintf(&b, "s;%s\n", v)
+		r, ok := new(big.Rat).SetString(v)
+		require.True(t, ok)
+		sum.Add(sum, r)
+	}
+	want := new(big.Rat).Quo(sum, big.NewRat(rows, 1)).FloatString(2)
+
+	res, err := Aggregate(context.Background(), b.String(), Options{Workers: 4})
+	require.NoError(t, err)
+	s := res.Stats["s"]
+	require.Equal(t, want, strconv.FormatFloat(s.Mean(), 'f', 2, 64))
+	require.Equal(t, int64(rows), s.Count)
+}
+
+func TestAggregateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	res, err := Aggregate(ctx, "stationA;10.00\n", Options{Workers: 2})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Zero(t, res.Rows)
+	require.Empty(t, res.Stats)
+	require.Zero(t, res.Bytes, "no chunk was got through")
+}
+
+func TestAggregateReaderPartialOnCancel(t *testing.T) {
+	data := strings.Repeat("stationA;10.00\nstationB;-5.00\n", 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Every read fills a block of 64 bytes, so the first two blocks are
+	// aggregated before the third read cancels the run.
+	r := &cancelingReader{Reader: strings.NewReader(data), cancel: cancel, after: 3}
+	res, err := aggregateReader(ctx, r, 64, Options{})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, int64(8), res.Rows, "two blocks of four 15-byte records")
+	require.Equal(t, int64(120), res.Bytes, "only the blocks aggregated")
+	require.Equal(t, res.Rows, res.Stats["stationA"].Count+res.Stats["stationB"].Count)
+}
+
+func TestMustRunInterrupted(t *testing.T) {
+	proc, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+
+	pr, pw, err := os.Pipe()
+	require.NoError(t, err)
+	orig := stdin
+	stdin = pr
+	defer func() { stdin = orig }()
+
+	// Feed records until the pipe is closed, and send SIGINT once more than
+	// two blocks have been read, so at least the first block has been
+	// aggregated. The cap only stops the test from hanging if the signal is
+	// ignored.
+	signaled := make(chan error, 1)
+	go func() {
+		defer close(signaled)
+		defer func() { _ = pw.Close() }()
+		record := []byte(strings.Repeat("stationA;10.00\nstationB;-5.00\n", 1000))
+		written := 0
+		for written < 256<<20 {
+			n, err := pw.Write(record)
+			if err != nil {
+				return
+			}
+			written += n
+			if written-n < 2*streamBlockSize+len(record) && written >= 2*streamBlockSize+len(record) {
+				signaled <- proc.Signal(os.Interrupt)
+			}
+		}
+	}()
+
+	var stdout, stderr bytes.Buffer
+	err = MustRun([]string{"gobillion", "-f", "-", "-counts"}, &stdout, &stderr)
+	_ = pr.Close()
+	if serr := <-signaled; serr != nil {
+		t.Skipf("can't send SIGINT on this platform: %v", serr)
+	}
+	require.ErrorIs(t, err, errInterrupted)
+	require.Regexp(t, `^\{stationA=10\.00/10\.00/10\.00/\d+, stationB=-5\.00/-5\.00/-5\.00/\d+\}\n$`, stdout.String())
+	require.Regexp(t, `level=WARN msg="Interrupted, printing partial results" rows=[1-9]\d*\n`, stderr.String())
+	require.Contains(t, stderr.String(), "RESULTS")
+}
+
+// cancelingReader cancels a context once the read numbered after returns, or
+// the first one if after is zero, so the streaming path observes the
+// cancellation part way through its input.
+type cancelingReader struct {
+	io.Reader
+	cancel context.CancelFunc
+	after  int
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.after--; r.after <= 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestAggregateReaderCanceledMidRun(t *testing.T) {
+	data := strings.Repeat("stationA;10.00\n", 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &cancelingReader{Reader: strings.NewReader(data), cancel: cancel}
+	_, err := aggregateReader(ctx, r, 64, Options{})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestReadNameWordBoundaries(t *testing.T) {
+	// readName reads eight bytes at a time and finishes the last few one by
+	// one, so a delimiter can be the first or last byte of a word, or in the
+	// tail. Names of 7, 8, 9, 15 and 16 bytes put it on either side of a word
+	// boundary.
+	for _, n := range []int{0, 1, 7, 8, 9, 15, 16, 17, 23, 24} {
+		name := strings.Repeat("n", n)
+		for _, rest := range []string{"", ";", ";1.00\n", ";;", ";\n", "\n", "\n;1.00"} {
+			input := name + rest
+			require.Equal(t, name, readName(input, ';'), "%q", input)
+		}
+		for _, delim := range []byte{',', '\t', '|'} {
+			input := name + string(delim) + "1.00;x"
+			require.Equal(t, name, readName(input, delim), "%q", input)
+		}
+	}
+
+	// Borrows in the SWAR test can flag bytes just above a delimiter; the
+	// first one found must still be the delimiter itself.
+	for _, input := range []string{"abc;:<;zzz", "abcdefg;\x01\x3a;", "abcdefgh\n;;;;;;;"} {
+		want := input[:strings.IndexAny(input, ";\n")]
+		require.Equal(t, want, readName(input, ';'), "%q", input)
+	}
+
+	// The same names through the whole parse, with the last record ending
+	// exactly at the end of the input, where only the tail loop looks at it.
+	for _, n := range []int{7, 8, 9, 15, 16} {
+		name := strings.Repeat("s", n)
+		data := name + ";1.50\n" + name + "x;-2.00\n" + name + ";2.50"
+		res, err := Aggregate(context.Background(), data, Options{Workers: 1})
+		require.NoError(t, err)
+		require.Equal(t, StationStats{Count: 2, Min: 150, Max: 250, Sum: 400}, res.Stats[name], name)
+		require.Equal(t, StationStats{Count: 1, Min: -200, Max: -200, Sum: -200}, res.Stats[name+"x"], name)
+	}
+}
+
+func FuzzReadName(f *testing.F) {
+	for _, seed := range []string{
+		"", ";", "a;1.00", "abcdefg;", "abcdefgh;", "abcdefghi;", "no semicolon",
+		"Zürich;1.00", "東京;-2.5", "\xff\xfe;;", strings.Repeat("x", 23) + ";",
+		"no\nsemicolon;1.00", "abcdefghij\n;",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		want := input
+		if i := strings.IndexAny(input, ";\n"); i >= 0 {
+			want = input[:i]
+		}
+		require.Equal(t, want, readName(input, ';'))
+	})
+}
+
+// tempSyntax is the temperature syntax parseTemp accepts. ParseFloat is more
+// lenient, taking "5.", ".5", "1e2" or "0x1p-2", so FuzzParseTemp only
+// expects the two to agree within it.
+var tempSyntax = regexp.MustCompile(`^[+-]?[0-9]{1,3}(\.[0-9]{1,2})?$`)
+
+func FuzzParseTemp(f *testing.F) {
+	for _, seed := range []string{
+		"1.23", "-12.34", "100.00", "-100.00", "-999.99", "+5", "7", "12.3",
+		"", "-", "+", "5.", ".5", "1.234", "1000", "NaN", "-Inf", "1e2", "0x10",
+		"1_0", "--1", " 1.0", "1.0 ", "٣.٤",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		got, ok := parseTemp(s, '.')
+		want, err := strconv.ParseFloat(s, 64)
+		if !ok {
+			require.Zero(t, got)
+			require.False(t, err == nil && tempSyntax.MatchString(s),
+				"parseTemp rejected %q, ParseFloat read %v", s, want)
+			return
+		}
+		require.NoError(t, err, "parseTemp accepted %q", s)
+		require.Regexp(t, tempSyntax, s)
+		require.InDelta(t, want, degrees(got), 1e-9, "input: %q", s)
+	})
+}
+
+// allowTinyChunks lets MustRun use every requested worker for the few bytes
+// of a test input, so the chunking and merging still get exercised.
+func allowTinyChunks(t *testing.T) {
+	orig := minChunkBytes
+	minChunkBytes = 1
+	t.Cleanup(func() { minChunkBytes = orig })
+}
+
+// testLogger logs to w like MustRun does, but without timestamps so that
+// records can be compared.
+func testLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
 }
 
 func makeFile(t *testing.T, contents string) (path string) {
@@ -58,3 +1999,70 @@ func makeFile(t *testing.T, contents string) (path string) {
 	require.NoError(t, err)
 	return path
 }
+
+// benchmarkData returns a few MB of records spread over 400 stations.
+func benchmarkData() string {
+	return benchmarkDataStations(400)
+}
+
+// benchmarkDataStations returns a few MB of records spread over the given
+// number of stations.
+func benchmarkDataStations(stations int) string {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var b strings.Builder
+	for b.Len() < 4<<20 {
+		fmt.Fprintf(&b, "weather station %d;%.2f\n",
+			rng.IntN(stations), -100+rng.Float64()*200)
+	}
+	return b.String()
+}
+
+func BenchmarkProcessChunk(b *testing.B) {
+	data := benchmarkData()
+	chunk := [2]int64{0, int64(len(data))}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for range b.N {
+		if _, err := processChunk(context.Background(), data, chunk, Options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAggregateReader streams 4MB in blocks of 256KB, so that every
+// block needs a station table of its own; run it with -benchmem to see what
+// that costs in allocations.
+func BenchmarkAggregateReader(b *testing.B) {
+	data := benchmarkData()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := aggregateReader(context.Background(), strings.NewReader(data), 256<<10, Options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseTemp(b *testing.B) {
+	for _, in := range []string{"1.23", "-12.34", "100.00"} {
+		b.Run(in, func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			for range b.N {
+				if _, ok := parseTemp(in, '.'); !ok {
+					b.Fatal("failed to parse", in)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadName(b *testing.B) {
+	for _, in := range []string{"Abha;1.00", "Ho Chi Minh City;1.00", "Las Palmas de Gran Canaria;1.00"} {
+		b.Run(in[:strings.IndexByte(in, ';')], func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			for range b.N {
+				readName(in, ';')
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// combineStats folds the stats of src into dst.
+func combineStats(dst, src *StationStats, opts Options) {
+	if opts.StdDev {
+		dst.M2 = mergeM2(dst, src)
+	}
+	dst.Min = min(dst.Min, src.Min)
+	dst.Max = max(dst.Max, src.Max)
+	dst.Sum += src.Sum
+	dst.Count += src.Count
+	if dst.Hist != nil {
+		dst.Hist.Merge(src.Hist)
+	}
+	if dst.Bins != nil {
+		dst.Bins.Merge(src.Bins)
+	}
+	if dst.Sample != nil {
+		dst.Sample.Merge(src.Sample)
+	}
+	if opts.Provenance {
+		dst.seen(src.First)
+		dst.seen(src.Last)
+	}
+}
+
+// mergeResults folds src into dst as if their inputs had been aggregated
+// together. The names in both results are owned copies, so they can be shared.
+func mergeResults(dst *Result, src Result, opts Options) {
+	for station, stats := range src.Stats {
+		if existing, ok := dst.Stats[station]; ok {
+			combineStats(&existing, &stats, opts)
+			dst.Stats[station] = existing
+		} else {
+			dst.Stats[station] = stats
+		}
+	}
+	dst.Rows += src.Rows
+	dst.Malformed += src.Malformed
+	dst.Bytes += src.Bytes
+	dst.WorkerTimes = append(dst.WorkerTimes, src.WorkerTimes...)
+}
+
+// mergeStats merges the per-worker stats in src into dst. Names are copied on
+// insertion so dst never references the memory src was parsed from, which may
+// be unmapped or reused once processing is done.
+func mergeStats(dst map[string]*StationStats, src *stationTable, opts Options) {
+	for station, stats := range src.all() {
+		if existing, ok := dst[station]; ok {
+			combineStats(existing, stats, opts)
+		} else {
+			s := *stats
+			dst[strings.Clone(station)] = &s
+		}
+	}
+}
+
+// mergeTables merges the stats in src into dst.
+func mergeTables(dst, src *stationTable, opts Options) {
+	for station, stats := range src.all() {
+		if existing, ok := dst.lookup(station); ok {
+			combineStats(existing, stats, opts)
+		} else {
+			*existing = *stats
+		}
+	}
+}
+
+// mergeTree merges the worker tables pairwise, halving the number of tables
+// every round, and returns the table holding the combined stats. The merges
+// of a round run in parallel; each one owns a distinct pair of tables, so no
+// locking is needed. tables must not be empty.
+func mergeTree(tables []*stationTable, opts Options) *stationTable {
+	for step := 1; step < len(tables); step *= 2 {
+		var wg sync.WaitGroup
+		for i := 0; i+step < len(tables); i += 2 * step {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mergeTables(tables[i], tables[i+step], opts)
+			}()
+		}
+		wg.Wait()
+	}
+	return tables[0]
+}
+
+// flattenStats converts merged stats into the value map returned to callers.
+func flattenStats(merged map[string]*StationStats) map[string]StationStats {
+	finalStats := make(map[string]StationStats, len(merged))
+	for station, stats := range merged {
+		finalStats[station] = *stats
+	}
+	return finalStats
+}
+
+// tableStats converts a merged table into the value map returned to callers.
+// Names are copied for the same reason as in mergeStats.
+func tableStats(t *stationTable) map[string]StationStats {
+	finalStats := make(map[string]StationStats, t.count)
+	for station, stats := range t.all() {
+		finalStats[strings.Clone(station)] = *stats
+	}
+	return finalStats
+}
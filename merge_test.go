@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeTreeMatchesSerialMerge(t *testing.T) {
+	var data string
+	for i := range 5000 {
+		data += fmt.Sprintf("station%d;%d.%02d\n", i%97, i%90-45, i%100)
+	}
+	opts := Options{Median: true}
+
+	for _, workers := range []int{1, 2, 3, 7, 8, 13} {
+		chunks, err := CalculateChunks(data, int64(len(data)), workers)
+		require.NoError(t, err)
+		process := func() []*stationTable {
+			tables := make([]*stationTable, workers)
+			for i, c := range chunks {
+				res, err := processChunk(context.Background(), data, c, opts)
+				require.NoError(t, err)
+				tables[i] = res.stats
+			}
+			return tables
+		}
+
+		serial := make(map[string]*StationStats)
+		for _, table := range process() {
+			mergeStats(serial, table, opts)
+		}
+
+		got := tableStats(mergeTree(process(), opts))
+		require.Equal(t, flattenStats(serial), got, "workers: %d", workers)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// writeMetrics writes the figures of a run to path in the Prometheus text
+// exposition format, for a textfile collector such as node_exporter's to pick
+// up. The file is replaced atomically, so a scrape never sees half of it.
+//
+// Every run replaces the figures of the previous one rather than adding to
+// them, so they are all gauges, and none is named _total as counters are.
+func writeMetrics(path string, result RunResult) error {
+	metrics := []struct {
+		name, kind, help, value string
+	}{
+		{"gobillion_rows", "gauge", "Rows parsed by the last run.",
+			strconv.FormatInt(result.Rows, 10)},
+		{"gobillion_stations", "gauge", "Distinct stations seen by the last run.",
+			strconv.Itoa(len(result.Stats))},
+		{"gobillion_duration_seconds", "gauge", "Wall-clock time of the last run.",
+			strconv.FormatFloat(result.Duration.Seconds(), 'g', -1, 64)},
+		{"gobillion_bytes", "gauge", "Input bytes consumed by the last run.",
+			strconv.FormatInt(result.Bytes, 10)},
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		for _, m := range metrics {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n",
+				m.name, m.help, m.name, m.kind, m.name, m.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMustRunMetrics(t *testing.T) {
+	data := "stationA;10.00\nstationB;20.00\nstationA;30.00\n"
+	p := makeFile(t, data)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gobillion.prom")
+	require.NoError(t, os.WriteFile(path, []byte("stale\n"), 0o644))
+
+	err := MustRun([]string{"gobillion", "-f", p, "-metrics", path}, io.Discard, io.Discard)
+	require.NoError(t, err)
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Regexp(t, `^# HELP gobillion_rows Rows parsed by the last run.
+# TYPE gobillion_rows gauge
+gobillion_rows 3
+# HELP gobillion_stations Distinct stations seen by the last run.
+# TYPE gobillion_stations gauge
+gobillion_stations 2
+# HELP gobillion_duration_seconds Wall-clock time of the last run.
+# TYPE gobillion_duration_seconds gauge
+gobillion_duration_seconds [0-9.e+-]+
+# HELP gobillion_bytes Input bytes consumed by the last run.
+# TYPE gobillion_bytes gauge
+gobillion_bytes 45
+$`, string(got))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no temporary file is left behind")
+
+	err = MustRun([]string{"gobillion", "-f", p, "-metrics", filepath.Join(dir, "missing", "x.prom")}, io.Discard, io.Discard)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.ErrorContains(t, err, "writing metrics: ")
+}
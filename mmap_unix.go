@@ -15,13 +15,28 @@ func mmapFile(file *os.File) (data string, cleanup func(), err error) {
 		return "", nil, err
 	}
 	fileSize := fi.Size()
+	if fileSize == 0 {
+		// Mapping zero bytes fails, and there is nothing to read anyway.
+		return "", func() {}, nil
+	}
+	if fileSize > maxMapSize {
+		return "", nil, fmt.Errorf("file of %d bytes is larger than the %d bytes this platform can map", fileSize, maxMapSize)
+	}
+	return mmapRange(file, 0, fileSize)
+}
 
+// mmapRange maps the length bytes of file starting at offset, which must be
+// more than zero. The mapping itself starts at the page boundary before
+// offset, as mmap requires.
+func mmapRange(file *os.File, offset, length int64) (data string, cleanup func(), err error) {
+	start := offset &^ int64(os.Getpagesize()-1)
 	b, err := syscall.Mmap(
-		int(file.Fd()), 0, int(fileSize), syscall.PROT_READ, syscall.MAP_SHARED,
+		int(file.Fd()), start, int(offset-start+length), syscall.PROT_READ, syscall.MAP_SHARED,
 	)
 	if err != nil {
 		return "", nil, err
 	}
+	advise(b)
 
 	cleanup = func() {
 		if err = syscall.Munmap(b); err != nil {
@@ -29,5 +44,5 @@ func mmapFile(file *os.File) (data string, cleanup func(), err error) {
 		}
 	}
 
-	return unsafe.String(&b[0], len(b)), cleanup, nil
+	return unsafe.String(&b[offset-start], length), cleanup, nil
 }
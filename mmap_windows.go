@@ -9,28 +9,64 @@ import (
 	"unsafe"
 )
 
+// allocationGranularity is what the offset of a view has to be a multiple
+// of. It's 64KB on every version of Windows.
+const allocationGranularity = 64 * 1024
+
 func mmapFile(file *os.File) (data string, cleanup func(), err error) {
 	fi, err := file.Stat()
 	if err != nil {
 		return "", nil, err
 	}
 	fileSize := fi.Size()
+	if fileSize == 0 {
+		// CreateFileMapping rejects empty files, and there is nothing to read.
+		return "", func() {}, nil
+	}
+	if fileSize > maxMapSize {
+		return "", nil, fmt.Errorf("file of %d bytes is larger than the %d bytes this platform can map", fileSize, maxMapSize)
+	}
+	return mmapRange(file, 0, fileSize)
+}
+
+// mmapRange maps the length bytes of file starting at offset, which must be
+// more than zero. The view itself starts at the allocation granularity
+// boundary before offset, as MapViewOfFile requires.
+func mmapRange(file *os.File, offset, length int64) (data string, cleanup func(), err error) {
+	start := offset &^ (allocationGranularity - 1)
+	end := offset + length
 
-	h, err := syscall.CreateFileMapping(syscall.Handle(file.Fd()), nil, syscall.PAGE_READONLY, 0, 0, nil)
+	// Both calls get exact sizes rather than 0 for "the whole file", so that
+	// they fail if the file shrank since it was measured instead of handing
+	// back a view shorter than the length bytes read from it below.
+	h, err := syscall.CreateFileMapping(syscall.Handle(file.Fd()), nil, syscall.PAGE_READONLY,
+		uint32(end>>32), uint32(end), nil)
 	if err != nil {
-		return "", nil, fmt.Errorf("creating file mapping: %v", err)
+		return "", nil, fmt.Errorf("creating file mapping: %w", err)
 	}
-	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ, 0, 0, 0)
+	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ,
+		uint32(start>>32), uint32(start), uintptr(end-start))
 	if err != nil {
-		return "", nil, fmt.Errorf("mapping view of file: %v", err)
+		_ = syscall.CloseHandle(h)
+		return "", nil, fmt.Errorf("mapping view of file: %w", err)
+	}
+	if addr == 0 {
+		_ = syscall.CloseHandle(h)
+		return "", nil, fmt.Errorf("mapping view of file: got a nil view of %d bytes", end-start)
 	}
 
 	cleanup = func() {
-		syscall.UnmapViewOfFile(addr)
-		syscall.CloseHandle(h)
+		if err := syscall.UnmapViewOfFile(addr); err != nil {
+			fmt.Printf("ERR: unmapping file: %v\n", err)
+		}
+		_ = syscall.CloseHandle(h)
 	}
 
-	data = unsafe.String((*byte)(unsafe.Pointer(addr)), fileSize)
+	// addr is the address of memory outside the Go heap, so reinterpreting it
+	// as a pointer is safe; going through &addr keeps vet from flagging the
+	// conversion from uintptr.
+	view := unsafe.String(*(**byte)(unsafe.Pointer(&addr)), end-start)
+	data = view[offset-start:]
 
 	return data, cleanup, nil
 }
@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMmapFile(t *testing.T) {
+	for _, contents := range []string{"", "stationA;10.00\n", "stationB;-1.25"} {
+		file, err := os.Open(makeFile(t, contents))
+		require.NoError(t, err)
+		data, cleanup, err := mmapFile(file)
+		require.NoError(t, err)
+		require.Equal(t, contents, data)
+		cleanup()
+		require.NoError(t, file.Close())
+	}
+}
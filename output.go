@@ -0,0 +1,291 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatBRC    = "brc"
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// ResultWriter writes aggregated stats in one output format. Each
+// implementation decides which stations to print, in which order and with
+// which fields, from the printOptions it was created with.
+type ResultWriter interface {
+	Write(w io.Writer, stats map[string]StationStats) error
+}
+
+// resultWriters maps every -format name to the constructor of its
+// ResultWriter. Adding a format means adding an entry here.
+var resultWriters = map[string]func(opts printOptions) ResultWriter{
+	formatBRC:    func(opts printOptions) ResultWriter { return braceWriter{opts} },
+	formatJSON:   func(opts printOptions) ResultWriter { return jsonWriter{opts} },
+	formatCSV:    func(opts printOptions) ResultWriter { return csvWriter{opts} },
+	formatNDJSON: func(opts printOptions) ResultWriter { return ndjsonWriter{opts} },
+}
+
+// newResultWriter returns the ResultWriter registered for format.
+func newResultWriter(format string, opts printOptions) (ResultWriter, error) {
+	newWriter, ok := resultWriters[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	return newWriter(opts), nil
+}
+
+// printResults writes stats to w with the ResultWriter for opts.format.
+func printResults(w io.Writer, stats map[string]StationStats, opts printOptions) error {
+	rw, err := newResultWriter(opts.format, opts)
+	if err != nil {
+		return err
+	}
+	return rw.Write(w, stats)
+}
+
+// stationOrder returns the names of the stations to print, in print order.
+// Names are compared byte by byte, which for UTF-8 is the same as ordering by
+// code point: it is stable across locales but isn't a linguistic collation, so
+// "Zürich" sorts after "Zurich" and every non-ASCII initial, like "Ærøskøbing",
+// sorts after all ASCII names.
+func stationOrder(stats map[string]StationStats, opts printOptions) []string {
+	stationNames := make([]string, 0, len(stats))
+	for name, s := range stats {
+		if s.Count >= opts.minCount {
+			stationNames = append(stationNames, name)
+		}
+	}
+	sort.Strings(stationNames)
+
+	if opts.top > 0 {
+		// Pick the busiest stations, then put them in the requested order.
+		sortStations(stationNames, stats, sortCount)
+		stationNames = stationNames[:min(opts.top, len(stationNames))]
+		sort.Strings(stationNames)
+	}
+	sortStations(stationNames, stats, opts.sort)
+	return stationNames
+}
+
+const (
+	sortName     = "name"
+	sortCount    = "count"
+	sortMean     = "mean"
+	sortMeanDesc = "mean-desc"
+	sortRange    = "range"
+)
+
+// sortStations orders names by mode, breaking ties alphabetically so stations
+// with equal stats come out in the same order on every run. Counts sort
+// busiest first and ranges widest first. Other modes leave names as they are.
+func sortStations(names []string, stats map[string]StationStats, mode string) {
+	var compare func(a, b StationStats) int
+	switch mode {
+	case sortCount:
+		compare = func(a, b StationStats) int { return cmp.Compare(b.Count, a.Count) }
+	case sortMean:
+		compare = func(a, b StationStats) int { return cmp.Compare(a.Mean(), b.Mean()) }
+	case sortMeanDesc:
+		compare = func(a, b StationStats) int { return cmp.Compare(b.Mean(), a.Mean()) }
+	case sortRange:
+		compare = func(a, b StationStats) int { return cmp.Compare(b.Max-b.Min, a.Max-a.Min) }
+	default:
+		return
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(compare(stats[a], stats[b]), strings.Compare(a, b))
+	})
+}
+
+// braceWriter writes the canonical 1BRC format, {name=min/avg/max, ...},
+// followed by a line of bins per station with -histogram.
+type braceWriter struct {
+	opts printOptions
+}
+
+func (bw braceWriter) Write(w io.Writer, stats map[string]StationStats) error {
+	opts := bw.opts
+	stationNames := stationOrder(stats, opts)
+	_, _ = fmt.Fprint(w, "{")
+	for i, name := range stationNames {
+		s := stats[name]
+		_, _ = fmt.Fprintf(w, "%s=%s/%s", name, opts.exactTemp(s.Min, 1), opts.exactTemp(s.Sum, s.Count))
+		if opts.median {
+			_, _ = fmt.Fprintf(w, "/%s", opts.formatTemp(s.Hist.Median(s.Count)))
+		}
+		_, _ = fmt.Fprintf(w, "/%s", opts.exactTemp(s.Max, 1))
+		if opts.stddev {
+			_, _ = fmt.Fprintf(w, "/%s", opts.formatSpread(s.StdDev()))
+		}
+		if opts.tempRange {
+			_, _ = fmt.Fprintf(w, "/%s", opts.formatSpread(s.Range()))
+		}
+		if opts.counts {
+			_, _ = fmt.Fprintf(w, "/%d", s.Count)
+		}
+		if opts.provenance {
+			_, _ = fmt.Fprintf(w, "/L%d-L%d", s.First, s.Last)
+		}
+		if i < len(stationNames)-1 {
+			_, _ = fmt.Fprint(w, ", ")
+		}
+	}
+	_, _ = fmt.Fprint(w, "}\n")
+
+	if opts.histogram {
+		for _, name := range stationNames {
+			_, _ = fmt.Fprintf(w, "%s: [%s]\n", name, stats[name].Bins)
+		}
+	}
+	if opts.sample {
+		for _, name := range stationNames {
+			s := stats[name]
+			_, _ = fmt.Fprintf(w, "%s sample: [%s]\n", name, opts.formatSample(s.Sample))
+		}
+	}
+	return nil
+}
+
+// jsonWriter writes the stats as a single JSON object keyed by station name.
+// It is built by hand rather than with encoding/json so that values keep the
+// same decimal formatting as the brace output.
+type jsonWriter struct {
+	opts printOptions
+}
+
+func (jw jsonWriter) Write(w io.Writer, stats map[string]StationStats) error {
+	stationNames := stationOrder(stats, jw.opts)
+	_, _ = fmt.Fprint(w, "{")
+	for i, name := range stationNames {
+		key, err := json.Marshal(name)
+		if err != nil {
+			return fmt.Errorf("encoding station name %q: %w", name, err)
+		}
+		s := stats[name]
+		_, _ = fmt.Fprintf(w, "%s:{", key)
+		writeJSONFields(w, &s, jw.opts)
+		_, _ = fmt.Fprint(w, "}")
+		if i < len(stationNames)-1 {
+			_, _ = fmt.Fprint(w, ",")
+		}
+	}
+	_, _ = fmt.Fprint(w, "}\n")
+	return nil
+}
+
+// ndjsonWriter writes one JSON object per station and line, with the name in
+// a "station" field, so consumers can stream the output instead of parsing
+// one object holding every station.
+type ndjsonWriter struct {
+	opts printOptions
+}
+
+func (nw ndjsonWriter) Write(w io.Writer, stats map[string]StationStats) error {
+	for _, name := range stationOrder(stats, nw.opts) {
+		station, err := json.Marshal(name)
+		if err != nil {
+			return fmt.Errorf("encoding station name %q: %w", name, err)
+		}
+		s := stats[name]
+		_, _ = fmt.Fprintf(w, `{"station":%s,`, station)
+		writeJSONFields(w, &s, nw.opts)
+		_, _ = fmt.Fprint(w, "}\n")
+	}
+	return nil
+}
+
+// writeJSONFields writes the fields of s shared by the JSON formats, without
+// the enclosing braces.
+func writeJSONFields(w io.Writer, s *StationStats, opts printOptions) {
+	_, _ = fmt.Fprintf(w, `"min":%s,"avg":%s,`, opts.exactTemp(s.Min, 1), opts.exactTemp(s.Sum, s.Count))
+	if opts.median {
+		_, _ = fmt.Fprintf(w, `"median":%s,`, opts.formatTemp(s.Hist.Median(s.Count)))
+	}
+	_, _ = fmt.Fprintf(w, `"max":%s,"count":%d`, opts.exactTemp(s.Max, 1), s.Count)
+	if opts.stddev {
+		_, _ = fmt.Fprintf(w, `,"stddev":%s`, opts.formatSpread(s.StdDev()))
+	}
+	if opts.tempRange {
+		_, _ = fmt.Fprintf(w, `,"range":%s`, opts.formatSpread(s.Range()))
+	}
+	if opts.provenance {
+		_, _ = fmt.Fprintf(w, `,"first_line":%d,"last_line":%d`, s.First, s.Last)
+	}
+	if opts.histogram {
+		_, _ = fmt.Fprintf(w, `,"histogram":[%s]`, s.Bins)
+	}
+	if opts.sample {
+		_, _ = fmt.Fprintf(w, `,"sample":[%s]`, opts.formatSample(s.Sample))
+	}
+}
+
+// csvWriter writes a header row followed by one row per station.
+// encoding/csv takes care of quoting names that contain commas or quotes.
+type csvWriter struct {
+	opts printOptions
+}
+
+func (cw csvWriter) Write(w io.Writer, stats map[string]StationStats) error {
+	opts := cw.opts
+	stationNames := stationOrder(stats, opts)
+	out := csv.NewWriter(w)
+	header := []string{"station", "min", "mean"}
+	if opts.median {
+		header = append(header, "median")
+	}
+	header = append(header, "max", "count")
+	if opts.stddev {
+		header = append(header, "stddev")
+	}
+	if opts.tempRange {
+		header = append(header, "range")
+	}
+	if opts.provenance {
+		header = append(header, "first_line", "last_line")
+	}
+	if err := out.Write(header); err != nil {
+		return err
+	}
+	for _, name := range stationNames {
+		s := stats[name]
+		record := []string{
+			name,
+			opts.exactTemp(s.Min, 1),
+			opts.exactTemp(s.Sum, s.Count),
+		}
+		if opts.median {
+			record = append(record, opts.formatTemp(s.Hist.Median(s.Count)))
+		}
+		record = append(record,
+			opts.exactTemp(s.Max, 1),
+			strconv.FormatInt(s.Count, 10),
+		)
+		if opts.stddev {
+			record = append(record, opts.formatSpread(s.StdDev()))
+		}
+		if opts.tempRange {
+			record = append(record, opts.formatSpread(s.Range()))
+		}
+		if opts.provenance {
+			record = append(record,
+				strconv.FormatInt(s.First, 10),
+				strconv.FormatInt(s.Last, 10),
+			)
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultWriters(t *testing.T) {
+	stats := map[string]StationStats{
+		"b": {Count: 2, Min: -150, Max: 2000, Sum: 1850},
+		"a": {Count: 1, Min: 1000, Max: 1000, Sum: 1000},
+	}
+	opts := printOptions{sort: sortName, unit: unitCelsius, precision: 2}
+	for format, want := range map[string]string{
+		formatBRC:  "{a=10.00/10.00/10.00, b=-1.50/9.25/20.00}\n",
+		formatJSON: `{"a":{"min":10.00,"avg":10.00,"max":10.00,"count":1},"b":{"min":-1.50,"avg":9.25,"max":20.00,"count":2}}` + "\n",
+		formatCSV:  "station,min,mean,max,count\na,10.00,10.00,10.00,1\nb,-1.50,9.25,20.00,2\n",
+		formatNDJSON: `{"station":"a","min":10.00,"avg":10.00,"max":10.00,"count":1}` + "\n" +
+			`{"station":"b","min":-1.50,"avg":9.25,"max":20.00,"count":2}` + "\n",
+	} {
+		rw, err := newResultWriter(format, opts)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, rw.Write(&buf, stats))
+		require.Equal(t, want, buf.String(), format)
+	}
+
+	_, err := newResultWriter("xml", opts)
+	require.EqualError(t, err, `unknown output format "xml"`)
+}
+
+func TestSortStationsTies(t *testing.T) {
+	// stationY and stationZ have the same stats, so only the name can order
+	// them in any mode.
+	stats := map[string]StationStats{
+		"stationZ": {Count: 2, Min: 100, Max: 300, Sum: 400},
+		"stationY": {Count: 2, Min: 100, Max: 300, Sum: 400},
+		"stationX": {Count: 1, Min: 500, Max: 500, Sum: 500},
+		"stationW": {Count: 3, Min: 0, Max: 0, Sum: 0},
+	}
+	for _, tt := range []struct {
+		mode string
+		want []string
+	}{
+		{sortMean, []string{"stationW", "stationY", "stationZ", "stationX"}},
+		{sortMeanDesc, []string{"stationX", "stationY", "stationZ", "stationW"}},
+		{sortCount, []string{"stationW", "stationY", "stationZ", "stationX"}},
+		{sortRange, []string{"stationY", "stationZ", "stationW", "stationX"}},
+	} {
+		// Start from reverse alphabetical order, so the result can't come
+		// from the input order.
+		names := []string{"stationZ", "stationY", "stationX", "stationW"}
+		sortStations(names, stats, tt.mode)
+		require.Equal(t, tt.want, names, tt.mode)
+	}
+}
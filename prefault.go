@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// prefaultSink keeps the compiler from dropping the reads of prefault.
+var prefaultSink byte
+
+// prefault touches every page of chunks in a background goroutine so that the
+// page faults of a cold, memory-mapped file are taken there rather than by the
+// workers parsing it. Workers all start at the beginning of their chunks, so
+// pages are touched round-robin across the chunks, the first page of each,
+// then the second of each and so on, which keeps it ahead of every worker as
+// long as touching a page is faster than parsing it. It only reads the data,
+// so it can't race with the workers, but the caller must call the returned
+// stop function, which waits for the goroutine to exit, before unmapping it.
+//
+// When data is already in the page cache there is nothing to read ahead and
+// prefault doesn't start at all.
+func prefault(data []string, chunks []string) (stop func()) {
+	if allCached(data) {
+		return func() {}
+	}
+	var quit atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		page := os.Getpagesize()
+		var sink byte
+		for off := 0; !quit.Load(); off += page {
+			touched := false
+			for _, c := range chunks {
+				if off < len(c) {
+					sink ^= c[off]
+					touched = true
+				}
+			}
+			if !touched {
+				break
+			}
+		}
+		prefaultSink = sink
+	}()
+	return func() {
+		quit.Store(true)
+		<-done
+	}
+}
+
+func allCached(data []string) bool {
+	for _, d := range data {
+		if !cached(d) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress counts the work done by a run so it can be reported while the run
+// is still going. Workers add to Done as they go; Total is zero when the size
+// of the job isn't known up front, as with stdin or compressed input. Rows is
+// the live total of records parsed by all workers, which processChunk adds to
+// in batches. All methods are safe to call on a nil *Progress, so callers
+// don't need to check whether reporting is enabled.
+type Progress struct {
+	Done  atomic.Int64
+	Total atomic.Int64
+	Rows  atomic.Int64
+}
+
+func (p *Progress) add(n int64) {
+	if p != nil {
+		p.Done.Add(n)
+	}
+}
+
+func (p *Progress) addRows(n int64) {
+	if p != nil {
+		p.Rows.Add(n)
+	}
+}
+
+func (p *Progress) setTotal(n int64) {
+	if p != nil {
+		p.Total.Store(n)
+	}
+}
+
+// reportProgress logs p to logger every interval from a ticker goroutine,
+// with the row count once there is one. The returned stop function logs a
+// final record and waits for the goroutine to exit; it must be called exactly
+// once.
+func reportProgress(
+	logger *slog.Logger, label, unit string, p *Progress, interval time.Duration,
+) (stop func()) {
+	report := func() {
+		done, total := p.Done.Load(), p.Total.Load()
+		attrs := []any{unit, done}
+		if total > 0 {
+			attrs = append(attrs, "total_"+unit, total,
+				"percent", fmt.Sprintf("%.1f", float64(done)/float64(total)*100))
+		}
+		if n := p.Rows.Load(); n > 0 {
+			attrs = append(attrs, "rows", n)
+		}
+		logger.Info(label, attrs...)
+	}
+
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-quit:
+				report()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregateProgress(t *testing.T) {
+	data := strings.Repeat("Hamburg;12.0\nBulawayo;8.9\nPalembang;38.8\n", 100)
+
+	var p Progress
+	_, err := Aggregate(context.Background(), data, Options{Workers: 3, Progress: &p})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), p.Done.Load())
+	require.Equal(t, int64(300), p.Rows.Load())
+
+	var sp Progress
+	_, err = aggregateReader(context.Background(), strings.NewReader(data), 64, Options{Progress: &sp})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), sp.Done.Load())
+	require.Equal(t, int64(300), sp.Rows.Load())
+}
+
+// BenchmarkAggregateProgress runs 32 workers with and without a shared
+// Progress. Each worker only adds to its counters every ctxCheckInterval rows,
+// so the shared cache lines are barely contended and both should run at the
+// same speed.
+func BenchmarkAggregateProgress(b *testing.B) {
+	data := benchmarkData()
+	for _, progress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("progress=%v", progress), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				opts := Options{Workers: 32}
+				if progress {
+					opts.Progress = new(Progress)
+				}
+				if _, err := Aggregate(context.Background(), data, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReportProgress(t *testing.T) {
+	var buf bytes.Buffer
+	var p Progress
+	p.setTotal(200)
+	p.add(50)
+
+	stop := reportProgress(testLogger(&buf), "Processing", "bytes", &p, time.Hour)
+	stop()
+	require.Equal(t, "level=INFO msg=Processing bytes=50 total_bytes=200 percent=25.0\n", buf.String())
+
+	buf.Reset()
+	p.setTotal(0)
+	stop = reportProgress(testLogger(&buf), "Processing", "bytes", &p, time.Hour)
+	stop()
+	require.Equal(t, "level=INFO msg=Processing bytes=50\n", buf.String())
+
+	buf.Reset()
+	p.addRows(7)
+	stop = reportProgress(testLogger(&buf), "Processing", "bytes", &p, time.Hour)
+	stop()
+	require.Equal(t, "level=INFO msg=Processing bytes=50 rows=7\n", buf.String())
+}
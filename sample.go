@@ -0,0 +1,96 @@
+package main
+
+import "slices"
+
+// A Sample holds a uniform random sample, without replacement, of up to K
+// readings of a station for -sample.
+//
+// Rather than replacing slots at random as reservoir sampling's algorithm R
+// does, every reading gets a pseudo-random key derived from the seed and the
+// reading's offset in the input, and the sample keeps the K readings with the
+// smallest keys. That is just as uniform, but merging two samples is simply
+// keeping the K smallest keys of both, which gives the same result whatever
+// order the chunks are processed and merged in. So a fixed seed gives the
+// same sample for any number of workers and either input path.
+type Sample struct {
+	K int
+	// Keys is a max-heap: Keys[0] is the largest key kept, the first to go
+	// when a reading with a smaller key comes along. Temps[i] is the reading
+	// with key Keys[i], in hundredths of a degree.
+	Keys  []uint64
+	Temps []int64
+}
+
+func newSample(k int) *Sample {
+	return &Sample{K: k, Keys: make([]uint64, 0, k), Temps: make([]int64, 0, k)}
+}
+
+// Add considers the reading temp with the given key for the sample.
+func (s *Sample) Add(key uint64, temp int64) {
+	if len(s.Keys) < s.K {
+		s.Keys = append(s.Keys, key)
+		s.Temps = append(s.Temps, temp)
+		s.up(len(s.Keys) - 1)
+		return
+	}
+	if s.K == 0 || key >= s.Keys[0] {
+		return
+	}
+	s.Keys[0], s.Temps[0] = key, temp
+	s.down(0)
+}
+
+// Merge adds the readings sampled by o to s.
+func (s *Sample) Merge(o *Sample) {
+	for i, key := range o.Keys {
+		s.Add(key, o.Temps[i])
+	}
+}
+
+// Values returns the sampled readings in hundredths of a degree, in ascending
+// order.
+func (s *Sample) Values() []int64 {
+	return slices.Sorted(slices.Values(s.Temps))
+}
+
+func (s *Sample) swap(i, j int) {
+	s.Keys[i], s.Keys[j] = s.Keys[j], s.Keys[i]
+	s.Temps[i], s.Temps[j] = s.Temps[j], s.Temps[i]
+}
+
+func (s *Sample) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if s.Keys[parent] >= s.Keys[i] {
+			return
+		}
+		s.swap(i, parent)
+		i = parent
+	}
+}
+
+func (s *Sample) down(i int) {
+	for {
+		largest, left, right := i, 2*i+1, 2*i+2
+		if left < len(s.Keys) && s.Keys[left] > s.Keys[largest] {
+			largest = left
+		}
+		if right < len(s.Keys) && s.Keys[right] > s.Keys[largest] {
+			largest = right
+		}
+		if largest == i {
+			return
+		}
+		s.swap(i, largest)
+		i = largest
+	}
+}
+
+// sampleKey returns the key of the reading at offset in the input, mixed with
+// SplitMix64 so that keys of neighbouring offsets are independent.
+func sampleKey(seed uint64, offset int64) uint64 {
+	z := seed + uint64(offset)*0x9e3779b97f4a7c15
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleMergeOrder(t *testing.T) {
+	const k = 10
+	whole := newSample(k)
+	parts := []*Sample{newSample(k), newSample(k), newSample(k)}
+	for i := range int64(1000) {
+		key := sampleKey(42, i)
+		whole.Add(key, i)
+		parts[i%3].Add(key, i)
+	}
+	require.Len(t, whole.Values(), k)
+
+	// However the readings were split and merged, the result is the same.
+	a := newSample(k)
+	a.Merge(parts[0])
+	a.Merge(parts[1])
+	a.Merge(parts[2])
+	b := newSample(k)
+	b.Merge(parts[2])
+	b.Merge(parts[0])
+	b.Merge(parts[1])
+	require.Equal(t, whole.Values(), a.Values())
+	require.Equal(t, whole.Values(), b.Values())
+}
+
+func TestSampleUniform(t *testing.T) {
+	// Every reading should make it into a sample of 10 out of 100 with a
+	// probability of 1/10.
+	hits := make([]int, 100)
+	const runs = 2000
+	for seed := range uint64(runs) {
+		s := newSample(10)
+		for i := range int64(100) {
+			s.Add(sampleKey(seed, i), i)
+		}
+		for _, v := range s.Values() {
+			hits[v]++
+		}
+	}
+	for i, h := range hits {
+		require.InDelta(t, runs/10, h, 60, "reading %d", i)
+	}
+}
+
+func TestMustRunSample(t *testing.T) {
+	allowTinyChunks(t)
+	rng := rand.New(rand.NewPCG(1, 2))
+	var b strings.Builder
+	for range 5000 {
+		fmt.Fprintf(&b, "station%d;%.2f\n", rng.IntN(3), -50+rng.Float64()*100)
+	}
+	b.WriteString("rare;1.00\n")
+	p := makeFile(t, b.String())
+
+	var outputs []string
+	for _, mode := range [][]string{{"-w", "1"}, {"-w", "4"}, {"-w", "3", "-shared"}, {"-stream"}} {
+		var stdout bytes.Buffer
+		args := append([]string{"gobillion", "-f", p, "-sample", "5", "-seed", "7"}, mode...)
+		require.NoError(t, MustRun(args, &stdout, io.Discard))
+		outputs = append(outputs, stdout.String())
+	}
+	for _, out := range outputs[1:] {
+		require.Equal(t, outputs[0], out)
+	}
+	require.Contains(t, outputs[0], "\nrare sample: [1.00]\n")
+	require.Regexp(t, `\nstation0 sample: \[(-?\d+\.\d\d,){4}-?\d+\.\d\d\]\n`, outputs[0])
+
+	var stdout bytes.Buffer
+	err := MustRun([]string{"gobillion", "-f", p, "-sample", "5", "-seed", "8"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.NotEqual(t, outputs[0], stdout.String())
+
+	stdout.Reset()
+	err = MustRun([]string{"gobillion", "-f", p, "-sample", "2", "-format", "json", "-filter", "rare"}, &stdout, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, `{"rare":{"min":1.00,"avg":1.00,"max":1.00,"count":1,"sample":[1.00]}}`+"\n", stdout.String())
+
+	err = MustRun([]string{"gobillion", "-f", p, "-sample", "2", "-format", "csv"}, io.Discard, io.Discard)
+	require.EqualError(t, err, "-sample is not supported with -format csv")
+}
+
+func TestRunSampleFiles(t *testing.T) {
+	// The files have the same layout, so every reading of the first is at
+	// the same offset in its file as the one 50 degrees warmer in the second.
+	var a, b strings.Builder
+	for v := 10; v < 50; v++ {
+		fmt.Fprintf(&a, "s;%d.00\n", v)
+		fmt.Fprintf(&b, "s;%d.00\n", v+50)
+	}
+	paths := []string{makeFile(t, a.String()), makeFile(t, b.String())}
+
+	for _, opts := range []Options{
+		{Workers: 2},
+		{Workers: 2, Stream: true},
+		{Workers: 2, Stream: true, Provenance: true},
+	} {
+		for seed := range uint64(5) {
+			opts.Sample, opts.SampleSeed = 4, seed
+			res, err := Run(context.Background(), paths, opts, nil)
+			require.NoError(t, err)
+			values := res.Stats["s"].Sample.Values()
+			require.Len(t, values, 4)
+			paired := 0
+			for _, v := range values {
+				if slices.Contains(values, v+5000) {
+					paired++
+				}
+			}
+			require.Less(t, paired, 2, "opts: %+v, sample: %v", opts, values)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// sharedShards is the number of lock stripes in a sharedStats. It's a power
+// of two so a shard can be picked by masking the name hash.
+const sharedShards = 256
+
+// sharedStats is the aggregate behind -shared: a single concurrent map that
+// every worker writes into directly, instead of a table per worker that has
+// to be merged afterwards. Names are spread over sharedShards maps, each with
+// its own lock, so workers only contend when they hit the same shard at the
+// same time.
+type sharedStats struct {
+	shards [sharedShards]sharedShard
+}
+
+type sharedShard struct {
+	mu    sync.Mutex
+	stats map[string]*StationStats
+	_     [40]byte // keep shards on separate cache lines
+}
+
+func newSharedStats() *sharedStats {
+	s := new(sharedStats)
+	for i := range s.shards {
+		s.shards[i].stats = make(map[string]*StationStats)
+	}
+	return s
+}
+
+// add records r for name. The name is copied on insertion since it
+// points into the input, which may be unmapped once processing is done.
+func (s *sharedStats) add(name string, r reading, opts *Options) {
+	shard := &s.shards[hashName(name)&(sharedShards-1)]
+	shard.mu.Lock()
+	st, ok := shard.stats[name]
+	if ok {
+		st.add(r.temp, opts.StdDev)
+	} else {
+		st = new(StationStats)
+		st.init(r.temp, opts)
+		shard.stats[strings.Clone(name)] = st
+	}
+	st.track(r, opts)
+	shard.mu.Unlock()
+}
+
+// flatten returns the stats of every shard as a single map.
+func (s *sharedStats) flatten() map[string]StationStats {
+	finalStats := make(map[string]StationStats)
+	for i := range s.shards {
+		for name, st := range s.shards[i].stats {
+			finalStats[name] = *st
+		}
+	}
+	return finalStats
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregateSharedMatchesPerWorker(t *testing.T) {
+	data := benchmarkData()
+	for _, opts := range []Options{
+		{Workers: 1},
+		{Workers: 6, Median: true, StdDev: true, Histogram: true},
+	} {
+		want, err := Aggregate(context.Background(), data, opts)
+		require.NoError(t, err)
+
+		opts.Shared = true
+		got, err := Aggregate(context.Background(), data, opts)
+		require.NoError(t, err)
+		require.Equal(t, want.Rows, got.Rows)
+		require.Len(t, got.Stats, len(want.Stats))
+		for name, w := range want.Stats {
+			g := got.Stats[name]
+			require.InDelta(t, w.M2, g.M2, 1e-6, name)
+			w.M2, g.M2 = 0, 0
+			require.Equal(t, w, g, name)
+		}
+	}
+}
+
+// BenchmarkAggregateShared compares the per-worker tables with -shared, for
+// few and many stations.
+func BenchmarkAggregateShared(b *testing.B) {
+	for _, stations := range []int{10, 400, 10_000} {
+		data := benchmarkDataStations(stations)
+		for _, workers := range []int{4, 16} {
+			for _, shared := range []bool{false, true} {
+				name := fmt.Sprintf("stations=%d/workers=%d/shared=%v", stations, workers, shared)
+				b.Run(name, func(b *testing.B) {
+					opts := Options{Workers: workers, Shared: shared}
+					b.SetBytes(int64(len(data)))
+					for range b.N {
+						if _, err := Aggregate(context.Background(), data, opts); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// streamBlockSize is how much input the streaming path buffers before handing
+// the complete lines in it to processChunk.
+const streamBlockSize = 4 * 1024 * 1024
+
+// aggregateReader is the streaming counterpart of Aggregate for inputs that
+// can't be memory-mapped, such as pipes. It reads r in blocks of about
+// blockSize bytes, cuts each block at its last newline and processes the
+// blocks one after another on the calling goroutine. Blocks are merged with
+// the same logic as the mmap workers, so the aggregates are identical. Like
+// Aggregate it returns a partial Result when ctx is canceled, though not
+// before a pending read of r returns.
+func aggregateReader(
+	ctx context.Context, r io.Reader, blockSize int, opts Options,
+) (Result, error) {
+	merged := make(map[string]*StationStats, 10_000)
+	var rows, malformed, consumed int64
+	var busy time.Duration
+
+	total, err := readBlocks(r, blockSize, func(block string, offset, lines int64) error {
+		blockOpts := opts
+		blockOpts.firstLine, blockOpts.offset = lines+1, opts.offset+offset
+		blockOpts.header = opts.SkipHeader && offset == 0
+		res, err := processChunk(ctx, block, blockChunk(block, offset), blockOpts)
+		if err != nil && !canceled(err) {
+			return atOffset(err, offset, lines)
+		}
+		mergeStats(merged, res.stats, opts)
+		releaseTable(res.stats)
+		rows += res.rows
+		malformed += res.malformed
+		consumed += res.bytes
+		busy += res.duration
+		return err
+	})
+	if err != nil && !canceled(err) {
+		return Result{}, err
+	}
+	if err != nil {
+		// Canceled: only count the blocks got through.
+		total = consumed
+	}
+
+	return Result{
+		Stats:       flattenStats(merged),
+		Rows:        rows,
+		Malformed:   malformed,
+		Bytes:       total,
+		WorkerTimes: []time.Duration{busy},
+	}, err
+}
+
+// aggregateStream is the parallel variant of aggregateReader used by -stream.
+// The calling goroutine's reads are buffered by a bufio.Reader and the blocks
+// are handed over a channel to opts.Workers goroutines, each of which keeps
+// its own stats; those are merged once the input is exhausted. Unlike the
+// mmap path it never needs the whole file in the address space, only about
+// blockSize bytes per worker.
+func aggregateStream(
+	ctx context.Context, r io.Reader, blockSize int, opts Options,
+) (Result, error) {
+	if opts.Workers < 1 {
+		return Result{}, fmt.Errorf("number of workers must be at least 1, got %d", opts.Workers)
+	}
+
+	type block struct {
+		data          string
+		offset, lines int64
+	}
+	blocks := make(chan block, opts.Workers)
+	results := make([]Result, opts.Workers)
+	errg, ctx := errgroup.WithContext(ctx)
+
+	for i := range results {
+		errg.Go(func() error {
+			merged := make(map[string]*StationStats)
+			var rows, malformed, consumed int64
+			var busy time.Duration
+			var err error
+			for b := range blocks {
+				blockOpts := opts
+				blockOpts.firstLine, blockOpts.offset = b.lines+1, opts.offset+b.offset
+				blockOpts.header = opts.SkipHeader && b.offset == 0
+				var res chunkResult
+				res, err = processChunk(ctx, b.data, blockChunk(b.data, b.offset), blockOpts)
+				if err != nil && !canceled(err) {
+					return atOffset(err, b.offset, b.lines)
+				}
+				mergeStats(merged, res.stats, opts)
+				releaseTable(res.stats)
+				rows += res.rows
+				malformed += res.malformed
+				consumed += res.bytes
+				busy += res.duration
+				if err != nil {
+					break
+				}
+			}
+			results[i] = Result{
+				Stats:       flattenStats(merged),
+				Rows:        rows,
+				Malformed:   malformed,
+				Bytes:       consumed,
+				WorkerTimes: []time.Duration{busy},
+			}
+			return err
+		})
+	}
+
+	var total int64
+	errg.Go(func() (err error) {
+		defer close(blocks)
+		br := bufio.NewReaderSize(r, blockSize)
+		total, err = readBlocks(br, blockSize, func(data string, offset, lines int64) error {
+			select {
+			case blocks <- block{data, offset, lines}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		return err
+	})
+
+	err := errg.Wait()
+	if err != nil && !canceled(err) {
+		return Result{}, err
+	}
+	result := results[0]
+	for _, res := range results[1:] {
+		mergeResults(&result, res, opts)
+	}
+	if err == nil {
+		// The blocks don't count a byte order mark the input starts with.
+		result.Bytes = total
+	}
+	return result, err
+}
+
+// blockChunk returns the chunk covering all of block, which starts at offset
+// in the input, minus the byte order mark if it is the first block.
+func blockChunk(block string, offset int64) [2]int64 {
+	var start int64
+	if offset == 0 {
+		start = bomLen(block)
+	}
+	return [2]int64{start, int64(len(block))}
+}
+
+// readBlocks reads r in blocks of about blockSize bytes and calls process with
+// each block cut at its last newline, so records are never split between
+// blocks, along with the offset of the block in r and the number of lines
+// before it. A block is grown when a single record doesn't fit. Each block is
+// a fresh copy that process may keep. It returns the number of bytes read.
+func readBlocks(
+	r io.Reader, blockSize int, process func(block string, offset, lines int64) error,
+) (int64, error) {
+	buf := make([]byte, blockSize)
+	var pending int // bytes in buf not yet processed
+	var total, offset, lines int64
+
+	for {
+		if pending == len(buf) {
+			// A single record is longer than the buffer, make room for it.
+			buf = append(buf, make([]byte, len(buf))...)
+		}
+
+		n, err := io.ReadFull(r, buf[pending:])
+		total += int64(n)
+		pending += n
+		eof := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !eof {
+			return total, fmt.Errorf("reading input: %w", err)
+		}
+
+		end := pending
+		if !eof {
+			end = bytes.LastIndexByte(buf[:pending], '\n') + 1
+		}
+		if end > 0 {
+			block := string(buf[:end])
+			if err := process(block, offset, lines); err != nil {
+				return total, err
+			}
+			offset += int64(end)
+			lines += int64(strings.Count(block, "\n"))
+			pending = copy(buf, buf[end:pending])
+		}
+
+		if eof {
+			return total, nil
+		}
+	}
+}
+
+// isGzip reports whether file starts with the gzip magic bytes.
+func isGzip(file *os.File) (bool, error) {
+	var magic [2]byte
+	n, err := file.ReadAt(magic[:], 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return n == len(magic) && magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// lineLimitReader reads the first n bytes of r and then on to the end of the
+// record the last of them is in, including its newline, for
+// Options.LimitBytes on inputs whose size isn't known up front.
+type lineLimitReader struct {
+	r    io.Reader
+	n    int64 // bytes left before the limit
+	last byte  // the last byte read
+	done bool
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	if l.done || (l.n == 0 && l.last == '\n') {
+		return 0, io.EOF
+	}
+	if l.n > 0 && int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	if n == 0 {
+		return 0, err
+	}
+	if l.n > 0 {
+		l.n -= int64(n)
+	} else if i := bytes.IndexByte(p[:n], '\n'); i >= 0 {
+		n, l.done = i+1, true
+	}
+	l.last = p[n-1]
+	return n, err
+}
+
+// lineCounter counts the lines read through it, for Options.Provenance
+// across inputs that are streamed.
+type lineCounter struct {
+	r        io.Reader
+	newlines int64
+	last     byte // the last byte read
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.newlines += int64(bytes.Count(p[:n], []byte{'\n'}))
+	if n > 0 {
+		c.last = p[n-1]
+	}
+	return n, err
+}
+
+// lines returns the number of lines read, a last line without a newline
+// included.
+func (c *lineCounter) lines() int64 {
+	if c.last != 0 && c.last != '\n' {
+		return c.newlines + 1
+	}
+	return c.newlines
+}
+
+// recordEnd returns the offset just past the first newline at or after offset
+// in the size bytes of file, or size if there is none.
+func recordEnd(file *os.File, offset, size int64) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+	for {
+		line, err := r.ReadSlice('\n')
+		offset += int64(len(line))
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF):
+			return size, nil
+		case err != nil:
+			return 0, err
+		}
+		return offset, nil
+	}
+}
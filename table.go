@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"iter"
+	"sync"
+)
+
+// FNV-1a parameters, see https://en.wikipedia.org/wiki/Fowler–Noll–Vo_hash_function
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// stationTable is an open-addressing hash table keyed on station name. It is
+// used by processChunk instead of a Go map: the hash is computed directly over
+// the name bytes and the stats are stored inline in the entries, so there is
+// no allocation per station and no pointer chasing on lookup. Collisions are
+// resolved by linear probing and the table doubles once it is half full.
+//
+// Probing only touches hashes, a dense slice of 8-byte words that stays in
+// cache, and the matching entry is compared by name only when the hashes are
+// equal. A zero hash marks an empty slot.
+//
+// Real data is often skewed towards a few busy stations, so the slot of the
+// most recent lookup is remembered and checked before the name is hashed at
+// all. A miss only costs a length comparison for most names.
+type stationTable struct {
+	hashes  []uint64
+	entries []tableEntry
+	count   int
+	mask    uint64
+	last    uint64 // slot of the most recent lookup
+}
+
+type tableEntry struct {
+	name  string
+	stats StationStats
+}
+
+// newStationTable returns a table sized to hold at least capacity stations
+// before it has to grow.
+func newStationTable(capacity int) *stationTable {
+	size := 16
+	for size < capacity*2 {
+		size *= 2
+	}
+	return &stationTable{
+		hashes:  make([]uint64, size),
+		entries: make([]tableEntry, size),
+		mask:    uint64(size - 1),
+	}
+}
+
+// tablePool holds tables released by releaseTable. Every block of the
+// streaming paths and every chunk of the mmap path gets a table sized for
+// 10,000 stations, about 4MB, that is garbage as soon as it has been merged;
+// reusing them keeps that churn away from the garbage collector.
+var tablePool sync.Pool
+
+// getStationTable is newStationTable, except that it reuses a released table
+// when one large enough is available.
+func getStationTable(capacity int) *stationTable {
+	if t, ok := tablePool.Get().(*stationTable); ok && len(t.hashes) >= capacity*2 {
+		return t
+	}
+	return newStationTable(capacity)
+}
+
+// releaseTable empties t and makes it available to getStationTable. t must not
+// be used afterwards. The stats are cleared but not whatever they point to,
+// so the Hist, Bins and Sample of stats merged elsewhere stay valid.
+func releaseTable(t *stationTable) {
+	clear(t.hashes)
+	clear(t.entries)
+	t.count, t.last = 0, 0
+	tablePool.Put(t)
+}
+
+// lookup returns the stats stored for name, inserting a zero value if the
+// name isn't in the table yet. found reports whether the name already existed.
+// The returned pointer is only valid until the next call to lookup, since
+// inserting may grow the table and move its entries.
+func (t *stationTable) lookup(name string) (stats *StationStats, found bool) {
+	if t.hashes[t.last] != 0 && t.entries[t.last].name == name {
+		return &t.entries[t.last].stats, true
+	}
+
+	h := hashName(name)
+	for i := h & t.mask; t.hashes[i] != 0; i = (i + 1) & t.mask {
+		if t.hashes[i] == h && t.entries[i].name == name {
+			t.last = i
+			return &t.entries[i].stats, true
+		}
+	}
+
+	if (t.count+1)*2 > len(t.hashes) {
+		t.grow()
+	}
+	t.count++
+	e := t.insert(h, name)
+	return &e.stats, false
+}
+
+// insert places a new entry for name in the first free slot of its probe
+// sequence. The caller must make sure name isn't already present.
+func (t *stationTable) insert(hash uint64, name string) *tableEntry {
+	i := hash & t.mask
+	for t.hashes[i] != 0 {
+		i = (i + 1) & t.mask
+	}
+	t.hashes[i] = hash
+	t.last = i
+	e := &t.entries[i]
+	e.name = name
+	return e
+}
+
+func (t *stationTable) grow() {
+	oldHashes, oldEntries := t.hashes, t.entries
+	t.hashes = make([]uint64, len(oldHashes)*2)
+	t.entries = make([]tableEntry, len(oldEntries)*2)
+	t.mask = uint64(len(t.hashes) - 1)
+	for i, h := range oldHashes {
+		if h != 0 {
+			t.insert(h, oldEntries[i].name).stats = oldEntries[i].stats
+		}
+	}
+}
+
+// all iterates over the stations in the table in no particular order.
+func (t *stationTable) all() iter.Seq2[string, *StationStats] {
+	return func(yield func(string, *StationStats) bool) {
+		for i, h := range t.hashes {
+			if h != 0 && !yield(t.entries[i].name, &t.entries[i].stats) {
+				return
+			}
+		}
+	}
+}
+
+// hashName is FNV-1a applied to 8-byte words rather than single bytes, which
+// cuts the number of multiplications for typical names by about 8x. Word-wise
+// FNV leaves the low bits poorly mixed, so the result goes through the
+// murmur3 finalizer before its low bits are used for indexing. The lowest bit
+// is always set so a hash is never zero.
+func hashName(name string) uint64 {
+	h := uint64(fnvOffset64)
+	for len(name) >= 8 {
+		h ^= binary.LittleEndian.Uint64([]byte(name[:8]))
+		h *= fnvPrime64
+		name = name[8:]
+	}
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= fnvPrime64
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h | 1
+}
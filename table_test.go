@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStationTable(t *testing.T) {
+	table := newStationTable(1) // force several grows
+	want := make(map[string]int64)
+
+	for i := range 5000 {
+		name := fmt.Sprintf("station-%d", i%1234)
+		s, found := table.lookup(name)
+		_, exists := want[name]
+		require.Equal(t, exists, found, name)
+		s.Count++
+		want[name]++
+	}
+
+	got := make(map[string]int64)
+	for name, s := range table.all() {
+		got[name] = s.Count
+	}
+	require.Equal(t, want, got)
+}
+
+func TestReleaseTable(t *testing.T) {
+	table := getStationTable(100)
+	for i := range 50 {
+		s, _ := table.lookup(fmt.Sprintf("station-%d", i))
+		s.init(int64(i)*100, &Options{Median: true})
+	}
+	kept, _ := table.lookup("station-7")
+	hist := kept.Hist
+	releaseTable(table)
+
+	// A reused table must come back empty, while stats copied out of it
+	// before the release keep their histograms.
+	require.Zero(t, table.count)
+	for name := range table.all() {
+		t.Fatalf("released table still holds %q", name)
+	}
+	s, found := table.lookup("station-7")
+	require.False(t, found)
+	require.Equal(t, StationStats{}, *s)
+	require.InDelta(t, 7.0, hist.Median(1), 1e-9)
+
+	require.GreaterOrEqual(t, len(getStationTable(10_000).hashes), 20_000)
+}
+
+func benchmarkNames() []string {
+	names := make([]string, 10_000)
+	for i := range names {
+		names[i] = fmt.Sprintf("weather station number %d", i)
+	}
+	return names
+}
+
+func BenchmarkStationTable(b *testing.B) {
+	names := benchmarkNames()
+	table := newStationTable(len(names))
+	b.ResetTimer()
+	for i := range b.N {
+		s, _ := table.lookup(names[i%len(names)])
+		s.Count++
+	}
+}
+
+func BenchmarkStationMap(b *testing.B) {
+	names := benchmarkNames()
+	stats := make(map[string]*StationStats, len(names))
+	b.ResetTimer()
+	for i := range b.N {
+		name := names[i%len(names)]
+		s, ok := stats[name]
+		if !ok {
+			s = &StationStats{}
+			stats[name] = s
+		}
+		s.Count++
+	}
+}
+
+// skewedNames returns a lookup sequence where a single station accounts for
+// nine out of ten rows, as happens with data dominated by one busy station.
+func skewedNames() []string {
+	names := benchmarkNames()
+	seq := make([]string, 100_000)
+	for i := range seq {
+		if i%10 == 0 {
+			seq[i] = names[i%len(names)]
+		} else {
+			seq[i] = names[0]
+		}
+	}
+	return seq
+}
+
+func BenchmarkStationTableSkewed(b *testing.B) {
+	seq := skewedNames()
+	table := newStationTable(10_000)
+	b.ResetTimer()
+	for i := range b.N {
+		s, _ := table.lookup(seq[i%len(seq)])
+		s.Count++
+	}
+}
+
+// BenchmarkStationTableSkewedUncached is BenchmarkStationTableSkewed with the
+// slot of the most recent lookup pointing at an empty slot before every
+// lookup, so every name is hashed and probed as it would be without the check.
+func BenchmarkStationTableSkewedUncached(b *testing.B) {
+	seq := skewedNames()
+	table := newStationTable(10_000)
+	for _, name := range seq {
+		table.lookup(name)
+	}
+	empty := uint64(slices.Index(table.hashes, 0))
+	b.ResetTimer()
+	for i := range b.N {
+		table.last = empty
+		s, _ := table.lookup(seq[i%len(seq)])
+		s.Count++
+	}
+}
+
+func BenchmarkStationMapSkewed(b *testing.B) {
+	seq := skewedNames()
+	stats := make(map[string]*StationStats, 10_000)
+	b.ResetTimer()
+	for i := range b.N {
+		name := seq[i%len(seq)]
+		s, ok := stats[name]
+		if !ok {
+			s = &StationStats{}
+			stats[name] = s
+		}
+		s.Count++
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and commit are set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=abc1234"
+//
+// When they're left empty, versionString falls back to the build info the Go
+// toolchain embeds in the binary.
+var (
+	version string
+	commit  string
+)
+
+// versionString reports the version, git commit and Go version the binary was
+// built with.
+func versionString() string {
+	v, c := version, commit
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		if c == "" {
+			var revision, modified string
+			for _, s := range info.Settings {
+				switch s.Key {
+				case "vcs.revision":
+					revision = s.Value
+				case "vcs.modified":
+					modified = s.Value
+				}
+			}
+			if c = revision; c != "" && modified == "true" {
+				c += "-dirty"
+			}
+		}
+	}
+	if v == "" {
+		v = "unknown"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	return fmt.Sprintf("billion-rows %s\ncommit: %s\ngo: %s\n", v, c, runtime.Version())
+}
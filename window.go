@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// mapWindow is how many bytes of a file aggregateWindows maps at a time. It's
+// a variable so tests can split small files into several windows.
+var mapWindow int64 = 1 << 30
+
+// aggregateWindows aggregates the size bytes of file without mapping all of
+// it at once, for files larger than the address space. It maps mapWindow bytes
+// at a time, cuts the window after its last complete record and processes it
+// with aggregateAll before unmapping it; the next window starts at the cut, so
+// windows overlap by the partial record at the end of each. The result is the
+// same as that of mapping the file whole. The number of lines in the file is
+// returned along with it.
+func aggregateWindows(ctx context.Context, file *os.File, size int64, opts Options) (Result, int64, error) {
+	result := Result{Stats: make(map[string]StationStats)}
+	var offset, lines int64
+	for offset < size {
+		length := min(mapWindow, size-offset)
+		data, cleanup, err := mmapRange(file, offset, length)
+		if err != nil {
+			return Result{}, 0, fmt.Errorf("mapping bytes %d to %d: %w", offset, offset+length, err)
+		}
+		end := int64(len(data))
+		if offset+end < size {
+			end = int64(strings.LastIndexByte(data, '\n')) + 1
+		}
+		if end == 0 {
+			cleanup()
+			return Result{}, 0, fmt.Errorf("record at byte %d is longer than the %d bytes mapped at a time", offset, mapWindow)
+		}
+
+		window := data[:end]
+		windowOpts := opts
+		windowOpts.offset = opts.offset + offset
+		windowOpts.SkipHeader = opts.SkipHeader && offset == 0
+		res, err := aggregateAll(ctx, []string{window}, windowOpts)
+		windowLines := countLines(window)
+		cleanup()
+		if err != nil && !canceled(err) {
+			return Result{}, 0, atOffset(err, offset, lines)
+		}
+		mergeSegment(&result, res, lines, opts)
+		if err != nil {
+			return result, lines, err
+		}
+		offset += end
+		lines += windowLines
+	}
+	return result, lines, nil
+}
+
+// mergeSegment merges the result of aggregating a segment of a file, which
+// starts after lines lines, into the result for the file so far. Line
+// numbers are shifted to count from the start of the file, and the time of
+// each worker is summed over the segments instead of listing every worker of
+// every segment.
+func mergeSegment(dst *Result, res Result, lines int64, opts Options) {
+	if opts.Provenance {
+		for name, st := range res.Stats {
+			st.First += lines
+			st.Last += lines
+			res.Stats[name] = st
+		}
+	}
+	for i, t := range res.WorkerTimes {
+		if i == len(dst.WorkerTimes) {
+			dst.WorkerTimes = append(dst.WorkerTimes, 0)
+		}
+		dst.WorkerTimes[i] += t
+	}
+	res.WorkerTimes = nil
+	mergeResults(dst, res, opts)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunWindow(t *testing.T) {
+	defer func(n int64) { mapWindow = n }(mapWindow)
+	mapWindow = 1000 // windows start in the middle of pages and records
+
+	data := benchmarkData()[:20_000]
+	data = data[:strings.LastIndexByte(data, '\n')+1]
+	opts := Options{Workers: 2, Median: true, StdDev: true, Provenance: true, Sample: 3, SampleSeed: 1}
+	want, err := Aggregate(context.Background(), data, opts)
+	require.NoError(t, err)
+
+	p := makeFile(t, data)
+	opts.Window = true
+	got, err := Run(context.Background(), []string{p}, opts, nil)
+	require.NoError(t, err)
+	require.Equal(t, want.Rows, got.Rows)
+	require.Equal(t, want.Bytes, got.Bytes)
+	require.Len(t, got.WorkerTimes, 2)
+	require.Len(t, got.Stats, len(want.Stats))
+	for name, w := range want.Stats {
+		g := got.Stats[name]
+		require.InDelta(t, w.M2, g.M2, 1e-6, name)
+		// The sample is the same, but its heap may be in a different order.
+		require.ElementsMatch(t, w.Sample.Keys, g.Sample.Keys, name)
+		require.ElementsMatch(t, w.Sample.Temps, g.Sample.Temps, name)
+		w.M2, g.M2 = 0, 0
+		w.Sample, g.Sample = nil, nil
+		require.Equal(t, w, g, name)
+	}
+
+	// Errors point at the record in the file, not in the window.
+	bad := strings.Index(data[5000:], "\n") + 5001
+	end := strings.IndexByte(data[bad:], '\n') + bad
+	p = makeFile(t, data[:end-1]+"x"+data[end:])
+	_, err = Run(context.Background(), []string{p}, opts, nil)
+	line := strings.Count(data[:bad], "\n") + 1
+	require.ErrorContains(t, err, fmt.Sprintf("on line %d (byte %d)", line, bad))
+}
+
+func TestMmapRange(t *testing.T) {
+	data := benchmarkData()[:200_000]
+	file, err := os.Open(makeFile(t, data))
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+
+	// Offsets on and off page and allocation granularity boundaries.
+	for _, offset := range []int64{0, 1, 4095, 4096, 4097, 65536, 70_000} {
+		got, cleanup, err := mmapRange(file, offset, 1000)
+		require.NoError(t, err, "offset %d", offset)
+		require.Equal(t, data[offset:offset+1000], got, "offset %d", offset)
+		cleanup()
+	}
+}
+
+func TestRunWindowLongRecord(t *testing.T) {
+	defer func(n int64) { mapWindow = n }(mapWindow)
+	mapWindow = 16
+
+	p := makeFile(t, "a;1\nstation with a long name;2\nb;3\n")
+	_, err := Run(context.Background(), []string{p}, Options{Workers: 1, Window: true}, nil)
+	require.EqualError(t, err, "record at byte 4 is longer than the 16 bytes mapped at a time")
+}